@@ -4,6 +4,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/anacrolix/missinggo"
@@ -60,3 +62,60 @@ func BenchmarkThroughput10MB(t *testing.B) {
 func BenchmarkThroughput1MB(t *testing.B) {
 	benchmarkThroughput(t, 1<<20)
 }
+
+// Transfers n bytes over each of numConns concurrent Conns between a pair of
+// Sockets, to measure the effect of lock contention across Conns.
+func benchmarkConcurrentConns(t *testing.B, numConns int, n int64) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	var dialed, accepted []net.Conn
+	for range iter.N(numConns) {
+		acceptedConn := make(chan net.Conn)
+		go func() {
+			c, err := s2.Accept()
+			require.NoError(t, err)
+			acceptedConn <- c
+		}()
+		c, err := s1.Dial(s2.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		dialed = append(dialed, c)
+		c = <-acceptedConn
+		defer c.Close()
+		accepted = append(accepted, c)
+	}
+	t.SetBytes(n * int64(numConns))
+	t.ReportAllocs()
+	t.ResetTimer()
+	for range iter.N(t.N) {
+		var wg sync.WaitGroup
+		for i := range dialed {
+			wg.Add(2)
+			go func(c net.Conn) {
+				defer wg.Done()
+				wn, err := io.CopyN(ioutil.Discard, c, n)
+				require.NoError(t, err)
+				require.EqualValues(t, n, wn)
+			}(accepted[i])
+			go func(c net.Conn) {
+				defer wg.Done()
+				wn, err := io.CopyN(c, missinggo.ZeroReader, n)
+				require.NoError(t, err)
+				require.EqualValues(t, n, wn)
+			}(dialed[i])
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkConcurrentConns(t *testing.B) {
+	for _, numConns := range []int{1, 4, 16} {
+		t.Run(strconv.Itoa(numConns), func(t *testing.B) {
+			benchmarkConcurrentConns(t, numConns, 1<<20)
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
@@ -37,6 +38,14 @@ func (a *C.utp_callback_arguments) addressLen() C.socklen_t {
 	return *(*C.socklen_t)(unsafe.Pointer(&a.anon1[0]))
 }
 
+func (a *C.utp_callback_arguments) send() C.int {
+	return *(*C.int)(unsafe.Pointer(&a.anon0))
+}
+
+func (a *C.utp_callback_arguments) overheadType() C.int {
+	return *(*C.int)(unsafe.Pointer(&a.anon1))
+}
+
 var (
 	sends         int64
 	sendToUdpAddr = net.UDPAddr{
@@ -51,6 +60,9 @@ func sendtoCallback(a *C.utp_callback_arguments) (ret C.uint64) {
 	if err := structSockaddrToUDPAddr(a.address(), &sendToUdpAddr); err != nil {
 		panic(err)
 	}
+	if s.intercept(b, &sendToUdpAddr, true) {
+		return
+	}
 	newSends := atomic.AddInt64(&sends, 1)
 	if logCallbacks {
 		Logger.Printf("sending %d bytes, %d packets", len(b), newSends)
@@ -72,13 +84,13 @@ func sendtoCallback(a *C.utp_callback_arguments) (ret C.uint64) {
 			// Rate-limited. Probably Linux. The implementation might try
 			// again later.
 		} else {
-			Logger.Printf("error sending packet: %s", err)
+			Logger.Printf("%serror sending packet: %s", c.logPrefix(), err)
 		}
 		return
 	}
 	if n != len(b) {
 		expMap.Add("socket PacketConn short writes", 1)
-		Logger.Printf("expected to send %d bytes but only sent %d", len(b), n)
+		Logger.Printf("%sexpected to send %d bytes but only sent %d", c.logPrefix(), len(b), n)
 	}
 	return
 }
@@ -89,13 +101,36 @@ func errorCallback(a *C.utp_callback_arguments) C.uint64 {
 	if logCallbacks {
 		log.Printf("error callback: socket %p: %s", a.socket, err)
 	}
-	libContextToSocket[a.context].conns[a.socket].onError(err)
+	libContextToSocket[a.context].onLibError(a.socket, err)
 	return 0
 }
 
+// Panicking here would take down the process, so errors for unknown sockets,
+// and after the first for a Conn, are only logged.
+func (s *Socket) onLibError(us *C.utp_socket, err error) {
+	c := s.conns[us]
+	if c == nil {
+		Logger.Printf("libutp error for unknown socket %p: %s", us, err)
+		return
+	}
+	if c.err != nil {
+		if logCallbacks {
+			Logger.Printf("%sconn %p: ignoring libutp error after %q: %s", c.logPrefix(), c, c.err, err)
+		}
+		return
+	}
+	c.onError(err)
+}
+
 //export logCallback
 func logCallback(a *C.utp_callback_arguments) C.uint64 {
-	Logger.Printf("libutp: %s", C.GoString((*C.char)(unsafe.Pointer(a.buf))))
+	c := getSocketForLibContext(a.context).conns[a.socket]
+	msg := c.logPrefix() + C.GoString((*C.char)(unsafe.Pointer(a.buf)))
+	if logHook == nil {
+		Logger.Printf("libutp: %s", msg)
+		return 0
+	}
+	logHook(c, msg)
 	return 0
 }
 
@@ -115,6 +150,8 @@ func stateChangeCallback(a *C.utp_callback_arguments) C.uint64 {
 		// circumstance occurs when c1 in the RacyRead nettest is the dialer.
 		C.utp_write(a.socket, nil, 0)
 	case C.UTP_STATE_WRITABLE:
+		c.flushCoalesced()
+		c.writableNotify.signal()
 		c.cond.Broadcast()
 	case C.UTP_STATE_EOF:
 		c.setGotEOF()
@@ -138,8 +175,15 @@ func readCallback(a *C.utp_callback_arguments) C.uint64 {
 	if len(b) == 0 {
 		panic("that will break the read drain invariant")
 	}
+	if c.readClosed {
+		// The read buffer stays empty, so libutp's receive window won't
+		// close.
+		return 0
+	}
 	c.readBuf.Write(b)
+	c.readableNotify.signal()
 	c.cond.Broadcast()
+	s.noteReadable(c)
 	return 0
 }
 
@@ -150,9 +194,27 @@ func acceptCallback(a *C.utp_callback_arguments) C.uint64 {
 	}
 	s := getSocketForLibContext(a.context)
 	c := s.newConn(a.socket)
-	c.setRemoteAddr()
 	c.inited = true
-	s.pushBacklog(c)
+	// The peer's SYN is all there is to the handshake for us.
+	c.gotConnect = true
+	if err := c.setRemoteAddr(); err != nil {
+		// Panicking here would take down the process. Reject the connection
+		// instead.
+		Logger.Printf("rejecting accepted conn: getting peer address: %s", err)
+		c.close()
+		return 0
+	}
+	s.connsAccepted++
+	s.addLiveConn(c)
+	// Queued after the OnConnect hook, so that Accept doesn't return the Conn
+	// before it's been passed to it.
+	mu.queueHook(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !s.closed {
+			s.pushBacklog(c)
+		}
+	})
 	return 0
 }
 
@@ -166,16 +228,73 @@ func getReadBufferSizeCallback(a *C.utp_callback_arguments) (ret C.uint64) {
 		// returns 0, so we'll return that.
 		return 0
 	}
-	ret = C.uint64(c.readBuf.Len())
+	n := c.readBuf.Len()
+	if c.maxReadBuf != 0 {
+		// libutp advertises its receive buffer size less what we report, so
+		// overstating the buffered data by the difference narrows the window
+		// to what's left under the cap. It opens again as Read consumes
+		// readBuf, which calls utp_read_drained.
+		if rcvbuf := int(C.utp_getsockopt(a.socket, C.UTP_RCVBUF)); rcvbuf > c.maxReadBuf {
+			n += rcvbuf - c.maxReadBuf
+		}
+	}
+	ret = C.uint64(n)
 	return
 }
 
+// These are the values libutp's default UTP_GET_UDP_MTU callback returns. It
+// assumes IPv6 is tunnelled over Teredo.
+const (
+	defaultUdpIpv4Mtu = 1500 - 20 - 8 - 24 - 8 - 2 - 36
+	defaultUdpIpv6Mtu = 1280 - 40 - 8
+)
+
+//export getUdpMtuCallback
+func getUdpMtuCallback(a *C.utp_callback_arguments) C.uint64 {
+	s := getSocketForLibContext(a.context)
+	if s.mtu != 0 {
+		return C.uint64(s.mtu)
+	}
+	if a.address().sa_family == syscall.AF_INET6 {
+		return defaultUdpIpv6Mtu
+	}
+	return defaultUdpIpv4Mtu
+}
+
+//export overheadStatisticsCallback
+func overheadStatisticsCallback(a *C.utp_callback_arguments) C.uint64 {
+	s := getSocketForLibContext(a.context)
+	if s.onOverheadStatistics == nil {
+		return 0
+	}
+	direction := OverheadReceived
+	if a.send() != 0 {
+		direction = OverheadSent
+	}
+	s.onOverheadStatistics(s.conns[a.socket], direction, int(a.len), int(a.overheadType()))
+	return 0
+}
+
 //export firewallCallback
 func firewallCallback(a *C.utp_callback_arguments) C.uint64 {
 	s := getSocketForLibContext(a.context)
-	if s.block {
+	if s.block || s.shuttingDown {
 		return 1
+	} else if s.maxConns != 0 && s.numConns >= s.maxConns {
+		return C.UTP_FIREWALL_RESET
+	} else if s.acceptFilter != nil && !s.acceptFilter(a.remoteAddr()) {
+		return C.UTP_FIREWALL_RESET
 	} else {
 		return 0
 	}
 }
+
+// Returns the address of a connecting peer, for the firewall callback. It's
+// not shared, so it can be retained.
+func (a *C.utp_callback_arguments) remoteAddr() net.Addr {
+	var addr net.UDPAddr
+	if err := structSockaddrToUDPAddr(a.address(), &addr); err != nil {
+		panic(err)
+	}
+	return &addr
+}
@@ -0,0 +1,144 @@
+package utp
+
+/*
+#include "utp.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Has writes smaller than maxBytes held and sent together, once maxBytes
+// accumulate or maxDelay passes after the first of them, whichever is sooner.
+// This trades latency for fewer cgo calls and fuller packets when writing
+// many small pieces. Held data has been accepted by Write, so it's sent even
+// if the Conn is closed before then, and only further writes are subject to
+// the write deadline. Writes that don't fit wait for the held data to be
+// sent. Flush, CloseWrite and TryWrite send held data first. Zero for both
+// disables coalescing.
+func (c *Conn) SetWriteCoalesce(maxDelay time.Duration, maxBytes int) error {
+	if maxDelay < 0 || maxBytes < 0 || (maxDelay == 0) != (maxBytes == 0) {
+		return fmt.Errorf("invalid write coalescing: max delay %v, max bytes %d", maxDelay, maxBytes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.coalesceDelay = maxDelay
+	c.coalesceMaxBytes = maxBytes
+	if maxBytes == 0 {
+		c.flushCoalesced()
+	}
+	return nil
+}
+
+func (c *Conn) writeCoalescing(ctx context.Context, b []byte) (n int, err error) {
+	if err = c.writeErr(); err != nil {
+		return
+	}
+	if len(b) >= c.coalesceMaxBytes {
+		// It's too big to hold, and would fill a packet anyway.
+		if err = c.drainCoalesced(ctx); err != nil {
+			return
+		}
+		return c.writeAll(ctx, b)
+	}
+	for len(c.coalesced)+len(b) > c.coalesceMaxBytes {
+		c.flushCoalesced()
+		if len(c.coalesced)+len(b) <= c.coalesceMaxBytes {
+			break
+		}
+		if err = c.writeErr(); err != nil {
+			return
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		c.cond.Wait()
+	}
+	if len(c.coalesced) == 0 {
+		c.resetCoalesceTimer(c.coalesceDelay)
+	}
+	c.coalesced = append(c.coalesced, b...)
+	c.lastActivity = time.Now()
+	if len(c.coalesced) >= c.coalesceMaxBytes {
+		c.flushCoalesced()
+	}
+	return len(b), nil
+}
+
+// Waits until all held data is given to libutp.
+func (c *Conn) drainCoalesced(ctx context.Context) error {
+	for {
+		c.flushCoalesced()
+		if len(c.coalesced) == 0 {
+			return nil
+		}
+		if err := c.writeErr(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.cond.Wait()
+	}
+}
+
+// Gives libutp as much held data as it, and the write limit, will take
+// without blocking. The rest is sent when the Conn is next writable, or when
+// the write limit allows. Held data is dropped if the Conn fails.
+func (c *Conn) flushCoalesced() {
+	if len(c.coalesced) == 0 {
+		return
+	}
+	defer c.cond.Broadcast()
+	for len(c.coalesced) != 0 {
+		if c.us == nil || c.err != nil {
+			c.coalesced = nil
+			break
+		}
+		b := c.coalesced
+		allowed := 0
+		if c.writeLimiter != nil {
+			var wait time.Duration
+			allowed, wait = c.writeLimiter.take(len(b), time.Now())
+			if allowed == 0 {
+				c.resetCoalesceTimer(wait)
+				return
+			}
+			b = b[:allowed]
+		}
+		n, err := c.utpWrite(b)
+		if allowed != 0 {
+			c.writeLimiter.giveBack(allowed - n)
+		}
+		if err != nil {
+			c.onError(err)
+			continue
+		}
+		if n == 0 {
+			return
+		}
+		c.coalesced = c.coalesced[n:]
+	}
+	c.coalesced = c.coalesced[:0]
+	if c.closePending && c.us != nil {
+		c.closePending = false
+		C.utp_close(c.us)
+	}
+}
+
+func (c *Conn) resetCoalesceTimer(d time.Duration) {
+	if c.coalesceTimer == nil {
+		c.coalesceTimer = time.AfterFunc(d, c.flushCoalescedLocking)
+	} else {
+		// A stale firing just flushes early.
+		c.coalesceTimer.Reset(d)
+	}
+}
+
+func (c *Conn) flushCoalescedLocking() {
+	mu.Lock()
+	c.flushCoalesced()
+	mu.Unlock()
+}
@@ -0,0 +1,146 @@
+package utp
+
+import (
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnSetWriteCoalesce(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	assert.Error(t, dc.SetWriteCoalesce(time.Second, 0))
+	assert.Error(t, dc.SetWriteCoalesce(0, 1))
+	assert.Error(t, dc.SetWriteCoalesce(-1, -1))
+
+	const delay = 50 * time.Millisecond
+	require.NoError(t, dc.SetWriteCoalesce(delay, 1000))
+	started := time.Now()
+	for _, b := range []string{"a", "b", "c"} {
+		n, err := d.Write([]byte(b))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	mu.Lock()
+	assert.Equal(t, "abc", string(dc.coalesced))
+	mu.Unlock()
+	b := make([]byte, 3)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+	assert.True(t, time.Since(started) >= delay)
+
+	// Reaching maxBytes sends the held data without waiting.
+	require.NoError(t, dc.SetWriteCoalesce(time.Hour, 4))
+	for _, b := range []string{"ab", "cd"} {
+		_, err := d.Write([]byte(b))
+		require.NoError(t, err)
+	}
+	b = make([]byte, 4)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(b))
+
+	// Disabling sends what's held.
+	_, err = d.Write([]byte("e"))
+	require.NoError(t, err)
+	require.NoError(t, dc.SetWriteCoalesce(0, 0))
+	_, err = io.ReadFull(a, b[:1])
+	require.NoError(t, err)
+	assert.Equal(t, "e", string(b[:1]))
+	assert.EqualValues(t, 8, dc.Stats().BytesWritten)
+}
+
+func TestConnWriteCoalesceClose(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc := d.(*Conn)
+	require.NoError(t, dc.SetWriteCoalesce(time.Hour, 1000))
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, dc.CloseWrite())
+	_, err = d.Write([]byte("world"))
+	assert.Error(t, err)
+	require.NoError(t, d.Close())
+	b, err := ioutil.ReadAll(a)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+// Held data is sent before the FIN, even though Close doesn't wait for it.
+func TestConnWriteCoalesceCloseFullWindow(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc := d.(*Conn)
+	require.NoError(t, dc.SetWriteCoalesce(time.Hour, 1000))
+	mu.Lock()
+	// Fill the send window, so the held data can't be sent at Close.
+	for {
+		n, err := dc.writeNoWait(make([]byte, 1<<16))
+		require.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+	dc.coalesced = append(dc.coalesced, "tail"...)
+	dc.close()
+	assert.True(t, dc.closePending)
+	mu.Unlock()
+	b, err := ioutil.ReadAll(a)
+	require.NoError(t, err)
+	assert.Equal(t, "tail", string(b[len(b)-4:]))
+}
+
+func benchmarkSmallWrites(b *testing.B, coalesce bool) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(b, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	if coalesce {
+		require.NoError(b, d.(*Conn).SetWriteCoalesce(time.Millisecond, 1<<10))
+	}
+	const writeSize = 16
+	go io.Copy(ioutil.Discard, a)
+	msg := make([]byte, writeSize)
+	b.SetBytes(writeSize)
+	b.ReportAllocs()
+	sendsBefore := atomic.LoadInt64(&sends)
+	cgoCallsBefore := runtime.NumCgoCall()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := d.Write(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(runtime.NumCgoCall()-cgoCallsBefore)/float64(b.N), "cgocalls/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&sends)-sendsBefore)/float64(b.N), "sends/op")
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	benchmarkSmallWrites(b, false)
+}
+
+func BenchmarkSmallWritesCoalesced(b *testing.B) {
+	benchmarkSmallWrites(b, true)
+}
@@ -10,7 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"reflect"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
@@ -18,40 +21,117 @@ import (
 )
 
 var (
-	ErrConnClosed            = errors.New("closed")
-	errConnDestroyed         = errors.New("destroyed")
+	// Returned by operations on a Conn after Close. It's net.ErrClosed, so
+	// callers can match it with errors.Is.
+	ErrClosed = net.ErrClosed
+	// Deprecated: Use ErrClosed.
+	ErrConnClosed = ErrClosed
+	// Returned once libutp has destroyed the Conn's underlying socket, such as
+	// when its Socket is closed.
+	ErrDestroyed = errors.New("destroyed")
+
+	errWriteClosed           = errors.New("write closed")
+	errNegativeCount         = errors.New("negative count")
 	errDeadlineExceededValue = errDeadlineExceeded{}
 )
 
 type Conn struct {
-	s          *Socket
-	us         *C.utp_socket
-	cond       sync.Cond
-	readBuf    bytes.Buffer
-	gotEOF     bool
-	gotConnect bool
+	s       *Socket
+	us      *C.utp_socket
+	cond    sync.Cond
+	readBuf *bytes.Buffer
+	// Set by SetMaxReceiveBuffer. Zero is no cap beyond libutp's.
+	maxReadBuf int
+	// Bytes read since libutp was last told, by readDrained.
+	readUndrained int
+	gotEOF        bool
+	gotConnect    bool
 	// Set on state changed to UTP_STATE_DESTROYING. Not valid to refer to the
 	// socket after getting this.
 	destroyed bool
 	// Conn.Close was called.
 	closed bool
+	// Closed once closed or destroyed is set, for watchers that can't wait
+	// on cond.
+	closedCh chan struct{}
 	// Corresponds to utp_socket.state != CS_UNITIALIZED. This requires the
 	// utp_socket was obtained from the accept callback, or has had
 	// utp_connect called on it. We can't call utp_close until it's true.
 	inited bool
+	// Conn.CloseWrite was called.
+	writeClosed bool
+	// Conn.CloseRead was called.
+	readClosed bool
+	// The Socket was created just for this Conn, and is closed with it.
+	ownsSocket bool
+	// Included in Socket.numConns.
+	counted bool
+	// Conn.SetKeepAlive(false) was called.
+	keepAliveDisabled bool
+	// Set by Conn.SetKeepAlivePeriod. Zero for libutp's default.
+	keepAlivePeriod time.Duration
 
 	err error
 
+	// The timers only wake waiters, who compare the deadlines with the time
+	// themselves, so they're Reset and Stopped under mu without caring
+	// whether they've already fired: a stale firing is a spurious wakeup, and
+	// a Reset always schedules another. The timer funcs take mu, so can't
+	// fire between a waiter's check and its Wait.
 	writeDeadline      time.Time
 	writeDeadlineTimer *time.Timer
 	readDeadline       time.Time
 	readDeadlineTimer  *time.Timer
+	// Set by SetReadIdleTimeout. readIdleDeadline is pushed back by it each
+	// time data is read.
+	readIdleTimeout  time.Duration
+	readIdleDeadline time.Time
+
+	// Set by SetReadLimit and SetWriteLimit. nil is unlimited.
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+
+	// Set by SetWriteCoalesce. coalesceMaxBytes is zero when it's disabled,
+	// though there may still be held data to send.
+	coalesceDelay    time.Duration
+	coalesceMaxBytes int
+	// Written data held for coalescing, and not yet given to libutp.
+	coalesced     []byte
+	coalesceTimer *time.Timer
+	// Close was called with data held, so utp_close is left to
+	// flushCoalesced.
+	closePending bool
 
 	numBytesRead    int64
 	numBytesWritten int64
+	// Retransmits as of the socket being destroyed.
+	retransmits int64
+	// When utp_connect was called for a dialed Conn, and how long until the
+	// peer's SYN ACK arrived.
+	connectStarted    time.Time
+	handshakeDuration time.Duration
+	// When data was last read or written, for Socket.SetIdleTimeout.
+	lastActivity time.Time
+	// The last packet size reported to Socket.onMtuChanged.
+	mtu int
+
+	// The buffer whose contents were last returned by ReadBuffer.
+	lentBuf *bytes.Buffer
 
 	localAddr  net.Addr
 	remoteAddr net.Addr
+	// In the Socket's ReadFromAny queue, and whether the end of the Conn's
+	// data has been reported there.
+	readAnyQueued bool
+	readAnyEnded  bool
+	// The Context given to Socket.AcceptContext, if that accepted it.
+	ctx context.Context
+
+	// Set by SetLabel.
+	label string
+	// Returned by WritableNotify and ReadableNotify.
+	writableNotify notifier
+	readableNotify notifier
 
 	// Called for non-fatal errors, such as packet write errors.
 	userOnError func(error)
@@ -59,24 +139,76 @@ type Conn struct {
 
 func (c *Conn) onError(err error) {
 	c.err = err
+	c.writableNotify.end()
+	c.readableNotify.end()
 	c.cond.Broadcast()
+	c.s.noteReadable(c)
+}
+
+// Counts bytes returned to the user, for the Conn and its Socket.
+func (c *Conn) addBytesRead(n int64) {
+	c.numBytesRead += n
+	c.s.bytesRead += n
+	if n != 0 {
+		c.lastActivity = time.Now()
+	}
+	if n != 0 && c.readIdleTimeout != 0 {
+		c.readIdleDeadline = time.Now().Add(c.readIdleTimeout)
+		c.resetReadDeadlineTimer()
+	}
+}
+
+// Counts bytes accepted from the user, for the Conn and its Socket.
+func (c *Conn) addBytesWritten(n int64) {
+	c.numBytesWritten += n
+	c.s.bytesWritten += n
 }
 
 func (c *Conn) setConnected() {
+	if !c.gotConnect && !c.counted {
+		c.s.connsDialed++
+		c.s.addLiveConn(c)
+	}
+	if !c.gotConnect {
+		c.lastActivity = time.Now()
+		if !c.connectStarted.IsZero() {
+			c.handshakeDuration = c.lastActivity.Sub(c.connectStarted)
+		}
+	}
 	c.gotConnect = true
+	c.writableNotify.signal()
 	c.cond.Broadcast()
 }
 
-func (c *Conn) waitForConnect(ctx context.Context) error {
+// Broadcasts cond from outside mu, such as from a timer. Waiters check their
+// conditions while holding mu, so without it the wakeup could come between
+// their check and their Wait, and be lost.
+func (c *Conn) broadcastLocking() {
+	mu.Lock()
+	c.cond.Broadcast()
+	mu.Unlock()
+}
+
+// Wakes waiters on the Conn's cond when ctx is done. The returned func must be
+// called to release the watcher goroutine.
+func (c *Conn) broadcastOnDone(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		// It's never done.
+		return func() {}
+	}
 	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
 	go func() {
 		<-ctx.Done()
-		c.cond.Broadcast()
+		c.broadcastLocking()
 	}()
+	return cancel
+}
+
+func (c *Conn) waitForConnect(ctx context.Context) error {
+	defer c.broadcastOnDone(ctx)()
 	for {
 		if c.closed {
-			return ErrConnClosed
+			return ErrClosed
 		}
 		if c.err != nil {
 			return c.err
@@ -91,6 +223,8 @@ func (c *Conn) waitForConnect(ctx context.Context) error {
 	}
 }
 
+// Closes the Conn without waiting for libutp to send the remaining data and
+// the FIN.
 func (c *Conn) Close() error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -98,89 +232,533 @@ func (c *Conn) Close() error {
 	return nil
 }
 
+// Closes the Conn, and waits for libutp to destroy the underlying socket, so
+// its resources are freed on return. That occurs once all written data and
+// the FIN have been acknowledged by the peer, or libutp gives up on the peer,
+// or the Socket is closed. Close doesn't wait.
+func (c *Conn) CloseSync() error {
+	mu.Lock()
+	defer mu.Unlock()
+	c.close()
+	if !c.inited {
+		return nil
+	}
+	for !c.destroyed {
+		c.cond.Wait()
+	}
+	return nil
+}
+
+// Waits until all data from the peer has been read, and the peer has sent
+// its FIN, then closes the Conn. Another goroutine must be reading the Conn
+// meanwhile. Close doesn't wait, so data still to come is lost. The read
+// deadline bounds the wait, which should be set in case the peer never closes
+// its end. The Conn is closed regardless, and the error says why it didn't
+// drain, such as a deadline error or the Conn failing.
+func (c *Conn) CloseAfterDrain() error {
+	mu.Lock()
+	defer mu.Unlock()
+	defer c.close()
+	for c.readBuf.Len() != 0 || !c.gotEOF {
+		switch {
+		case c.err != nil:
+			return c.err
+		case c.closed:
+			return ErrClosed
+		case c.destroyed:
+			return ErrDestroyed
+		case c.readDeadlineExceeded():
+			return errDeadlineExceededValue
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
+// Closes the Conn, and waits up to timeout for libutp to destroy the
+// underlying socket, which occurs once all written data and the FIN have been
+// acknowledged by the peer. A timeout error is returned if that doesn't occur
+// in time, but the Conn is closed regardless.
+func (c *Conn) CloseWithTimeout(timeout time.Duration) error {
+	mu.Lock()
+	defer mu.Unlock()
+	c.close()
+	if !c.inited {
+		// There's nothing to flush.
+		return nil
+	}
+	timedOut := false
+	t := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		timedOut = true
+		c.cond.Broadcast()
+		mu.Unlock()
+	})
+	defer t.Stop()
+	for !c.destroyed {
+		if timedOut {
+			return errDeadlineExceededValue
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
 func (c *Conn) close() {
 	if c.inited && !c.destroyed && !c.closed {
-		C.utp_close(c.us)
+		c.flushCoalesced()
+		if len(c.coalesced) == 0 {
+			C.utp_close(c.us)
+		} else {
+			// There's no blocking here, so the FIN waits for flushCoalesced
+			// to send the rest.
+			c.closePending = true
+		}
+	}
+	c.markClosed()
+}
+
+// Aborts the Conn with a reset, so the peer's reads and writes fail with
+// ErrConnReset instead of it reading EOF. Data not yet acknowledged, or held
+// by SetWriteCoalesce, is discarded, and the Conn is destroyed without
+// waiting. Close instead sends a FIN once the data written has been, and
+// lingers until it's acknowledged. Afterwards, operations on the Conn return
+// ErrClosed, as after Close.
+func (c *Conn) Reset() error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case c.closed:
+		return ErrClosed
+	case c.destroyed:
+		return ErrDestroyed
+	}
+	if c.inited {
+		c.coalesced = nil
+		C.utp_reset(c.us)
 	}
+	c.markClosed()
+	return nil
+}
+
+func (c *Conn) markClosed() {
 	if !c.inited {
 		// We'll never receive a destroy message, so we should remove it now.
 		delete(c.s.conns, c.us)
+		c.closeOwnedSocket()
 	}
+	c.closeClosedCh()
 	c.closed = true
+	c.writableNotify.end()
+	c.readableNotify.end()
 	c.cond.Broadcast()
 }
 
+// Closes closedCh, if it isn't already. A Conn may be destroyed before or
+// after it's closed.
+func (c *Conn) closeClosedCh() {
+	select {
+	case <-c.closedCh:
+	default:
+		close(c.closedCh)
+	}
+}
+
+// Closes the Conn when ctx is done, tying the Conn's lifetime to it.
+// Otherwise the watcher started for it stops when the Conn is closed, or
+// destroyed.
+func (c *Conn) BindContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.closedCh:
+		}
+	}()
+}
+
+// Shuts down the writing side of the Conn, sending a FIN to the peer so it
+// reads EOF. Data from the peer can still be read until it closes its side.
+// Further writes return an error.
+func (c *Conn) CloseWrite() error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case c.closed:
+		return ErrClosed
+	case c.destroyed:
+		return ErrDestroyed
+	case !c.inited:
+		return errors.New("not connected")
+	case c.writeClosed:
+		return nil
+	}
+	// The FIN must follow any held data.
+	if err := c.drainCoalesced(context.Background()); err != nil {
+		return err
+	}
+	C.utp_shutdown(c.us, C.SHUT_WR)
+	c.writeClosed = true
+	c.writableNotify.end()
+	c.cond.Broadcast()
+	return nil
+}
+
+// Shuts down the reading side of the Conn. Buffered data is discarded, and
+// further data from the peer is dropped. Reads return io.EOF.
+func (c *Conn) CloseRead() error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case c.closed:
+		return ErrClosed
+	case c.destroyed:
+		return ErrDestroyed
+	case c.readClosed:
+		return nil
+	}
+	c.readClosed = true
+	c.readableNotify.end()
+	if c.inited {
+		// libutp stops delivering data, but continues to ack it.
+		C.utp_shutdown(c.us, C.SHUT_RD)
+	}
+	if c.readBuf.Len() != 0 {
+		c.readBuf = new(bytes.Buffer)
+		c.readDrained()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// Returns the address of the Socket the Conn belongs to. It's set when the
+// Conn is created and doesn't change.
 func (c *Conn) LocalAddr() net.Addr {
 	return c.localAddr
 }
 
+// Tells libutp data has been read from the buffer, so it can reopen the
+// receive window. Unless the window was closed, libutp only defers an ack carrying
+// the new window, and deferred acks are otherwise only issued after receiving
+// packets, which a peer held up by the window may not be sending.
+func (c *Conn) readDrained() {
+	c.readUndrained = 0
+	C.utp_read_drained(c.us)
+	c.s.afterReceivingUtpMessages()
+}
+
+// How much reading that leaves data buffered has to consume before libutp is
+// told, so that a reader taking small pieces from a full buffer reopens the
+// window before the buffer is empty, without costing a cgo call and an ack
+// per read.
+const readDrainedInterval = 16 << 10
+
+// Tells libutp n bytes were read from readBuf, if that emptied it or enough
+// has been read since it was last told.
+func (c *Conn) readConsumed(n int) {
+	// Can we call this if the utp_socket is closed, destroyed or errored?
+	if n == 0 || c.us == nil {
+		return
+	}
+	c.readUndrained += n
+	if c.readBuf.Len() == 0 || c.readUndrained >= readDrainedInterval {
+		c.readDrained()
+	}
+}
+
 func (c *Conn) readNoWait(b []byte) (n int, err error) {
 	n, _ = c.readBuf.Read(b)
-	if n != 0 && c.readBuf.Len() == 0 {
-		// Can we call this if the utp_socket is closed, destroyed or errored?
-		if c.us != nil {
-			C.utp_read_drained(c.us)
-			// C.utp_issue_deferred_acks(C.utp_get_context(c.s))
-		}
-	}
-	if c.readBuf.Len() != 0 {
+	c.readConsumed(n)
+	if n != 0 || c.readBuf.Len() != 0 {
+		// Errors, including EOF, are only returned once there's nothing left
+		// to read, and not with the last of the data.
 		return
 	}
-	err = func() error {
-		switch {
-		case c.gotEOF:
-			return io.EOF
-		case c.err != nil:
-			return c.err
-		case c.destroyed:
-			return errConnDestroyed
-		case c.closed:
-			return ErrConnClosed
-		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
-			return errDeadlineExceededValue
-		default:
-			return nil
-		}
-	}()
+	err = c.readErr()
 	return
 }
 
+// The error for reading once the read buffer is empty, or nil if it's worth
+// waiting for more data.
+func (c *Conn) readErr() error {
+	switch {
+	case c.readClosed:
+		return io.EOF
+	case c.err == ErrConnReset:
+		// The peer aborted, even if it had sent its FIN, so that readers can
+		// tell it from a clean close.
+		return c.err
+	case c.gotEOF:
+		return io.EOF
+	case c.err != nil:
+		return c.err
+	case c.closed:
+		return ErrClosed
+	case c.destroyed:
+		return ErrDestroyed
+	case c.readDeadlineExceeded():
+		return errDeadlineExceededValue
+	default:
+		return nil
+	}
+}
+
 func (c *Conn) Read(b []byte) (int, error) {
+	return c.ReadContext(context.Background(), b)
+}
+
+// Like Read, but returns ctx's error if it's done before there's anything to
+// read.
+func (c *Conn) ReadContext(ctx context.Context, b []byte) (int, error) {
 	mu.Lock()
 	defer mu.Unlock()
+	defer c.broadcastOnDone(ctx)()
 	for {
-		n, err := c.readNoWait(b)
-		c.numBytesRead += int64(n)
+		rb := b
+		allowed := 0
+		if c.readLimiter != nil && c.readBuf.Len() != 0 && len(b) != 0 {
+			var wait time.Duration
+			allowed, wait = c.readLimiter.take(len(b), time.Now())
+			if allowed == 0 {
+				if c.readDeadlineExceeded() {
+					return 0, errDeadlineExceededValue
+				}
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				c.waitAtMost(wait)
+				continue
+			}
+			rb = b[:allowed]
+		}
+		n, err := c.readNoWait(rb)
+		if allowed != 0 {
+			c.readLimiter.giveBack(allowed - n)
+		}
+		c.addBytesRead(int64(n))
 		// log.Printf("read %d bytes", c.numBytesRead)
 		if n != 0 || len(b) == 0 || err != nil {
 			// log.Printf("conn %p: read %d bytes: %s", c, n, err)
 			return n, err
 		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		c.cond.Wait()
 	}
 }
 
-func (c *Conn) writeNoWait(b []byte) (n int, err error) {
-	err = func() error {
-		switch {
-		case c.err != nil:
-			return c.err
-		case c.closed:
-			return ErrConnClosed
-		case c.destroyed:
-			return errConnDestroyed
-		case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
-			return errDeadlineExceededValue
-		default:
-			return nil
+// Reads until b is full, like io.ReadFull. If the Conn reaches EOF part way,
+// it returns io.ErrUnexpectedEOF. The read deadline is absolute, so it bounds
+// the whole call rather than each Read, and if it passes part way n is the
+// number of bytes read so far.
+func (c *Conn) ReadFull(b []byte) (n int, err error) {
+	return io.ReadFull(c, b)
+}
+
+// Fills bufs in turn from the received data under one lock, such as to read
+// a header and body together. It blocks until there's something to read, as
+// Read does, but not until bufs are full. stopped is the index of the buffer
+// the data ran out in, or len(bufs) if they were all filled. Errors,
+// including EOF, are only returned once there's nothing left to read. The
+// read limit doesn't apply.
+func (c *Conn) ReadVectored(bufs [][]byte) (n, stopped int, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		for stopped < len(bufs) && len(bufs[stopped]) == 0 {
+			stopped++
 		}
-	}()
+		if stopped == len(bufs) {
+			return
+		}
+		stopped = 0
+		if err = c.readErr(); err != nil {
+			return
+		}
+		c.cond.Wait()
+	}
+	for ; stopped < len(bufs); stopped++ {
+		b := bufs[stopped]
+		n1, _ := c.readBuf.Read(b)
+		n += n1
+		if n1 < len(b) {
+			break
+		}
+	}
+	c.readConsumed(n)
+	c.addBytesRead(int64(n))
+	return
+}
+
+// Reads buffered data without blocking. If there's none, and no other error
+// applies, it returns ErrWouldBlock.
+func (c *Conn) TryRead(b []byte) (n int, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	n, err = c.readNoWait(b)
+	c.addBytesRead(int64(n))
+	if n == 0 && len(b) != 0 && err == nil {
+		err = ErrWouldBlock
+	}
+	return
+}
+
+// Returns all the buffered data, blocking until there is some, without copying
+// it. The returned slice is only valid until the next call to ReadBuffer, and
+// must not be retained after that. At EOF, it returns io.EOF.
+func (c *Conn) ReadBuffer() ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		if err := c.readErr(); err != nil {
+			return nil, err
+		}
+		c.cond.Wait()
+	}
+	// The previously lent buffer becomes the read buffer.
+	c.lentBuf.Reset()
+	c.readBuf, c.lentBuf = c.lentBuf, c.readBuf
+	b := c.lentBuf.Bytes()
+	c.addBytesRead(int64(len(b)))
+	if c.us != nil {
+		c.readDrained()
+	}
+	return b, nil
+}
+
+// Holds the buffers lent by ReadPooled, which become Conns' read buffers.
+var readPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Like ReadBuffer, but the returned slice is valid until release is called,
+// however the Conn is used meanwhile. It's taken from the Conn without
+// copying, and is replaced by a buffer released earlier, by any Conn, so that
+// a reader that handles data promptly doesn't allocate. release must be
+// called once b is no longer used. Later calls do nothing. release is nil if
+// err isn't.
+func (c *Conn) ReadPooled() (b []byte, release func(), err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		if err = c.readErr(); err != nil {
+			return
+		}
+		c.cond.Wait()
+	}
+	lent := c.readBuf
+	c.readBuf = readPool.Get().(*bytes.Buffer)
+	c.readBuf.Reset()
+	b = lent.Bytes()
+	c.addBytesRead(int64(len(b)))
+	if c.us != nil {
+		c.readDrained()
+	}
+	var once sync.Once
+	release = func() {
+		once.Do(func() { readPool.Put(lent) })
+	}
+	return
+}
+
+// Returns the number of bytes that can be read without blocking.
+func (c *Conn) Buffered() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.readBuf.Len()
+}
+
+// Returns a copy of up to n buffered bytes without consuming them. It blocks
+// until at least one byte is available, or reading would fail.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errNegativeCount
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		if err := c.readErr(); err != nil {
+			return nil, err
+		}
+		c.cond.Wait()
+	}
+	b := c.readBuf.Bytes()
+	if n < len(b) {
+		b = b[:n]
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (c *Conn) writeNoWait(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		// There's no &b[0] to give libutp.
+		return
+	}
+	err = c.writeErr()
 	if err != nil {
 		return
 	}
+	return c.utpWrite(b)
+}
+
+// Gives b to libutp, which must still have the socket. b must not be empty.
+func (c *Conn) utpWrite(b []byte) (n int, err error) {
 	n = int(C.utp_write(c.us, unsafe.Pointer(&b[0]), C.size_t(len(b))))
 	if n < 0 {
-		panic(n)
+		// libutp only does this for arguments it considers invalid, in which
+		// case the Conn's state is beyond us. Don't take the process down
+		// with mu held.
+		err = fmt.Errorf("utp_write returned %d", n)
+		n = 0
+	}
+	if n != 0 {
+		// Updated here rather than in addBytesWritten, so that a long Write
+		// that's making progress isn't considered idle.
+		c.lastActivity = time.Now()
+	}
+	return
+}
+
+// The error for writing, or nil if it's worth trying.
+func (c *Conn) writeErr() error {
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.closed:
+		return ErrClosed
+	case c.destroyed:
+		return ErrDestroyed
+	case c.writeClosed:
+		return errWriteClosed
+	case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
+		return errDeadlineExceededValue
+	default:
+		return nil
+	}
+}
+
+// Writes as much of b as libutp will accept without blocking. If it accepts
+// nothing because the send window is full, it returns ErrWouldBlock.
+func (c *Conn) TryWrite(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Held data goes first.
+	c.flushCoalesced()
+	if len(c.coalesced) == 0 {
+		n, err = c.writeNoWait(b)
+	} else {
+		err = c.writeErr()
+	}
+	c.addBytesWritten(int64(n))
+	if n == 0 && err == nil {
+		err = ErrWouldBlock
 	}
 	return
 }
@@ -188,9 +766,92 @@ func (c *Conn) writeNoWait(b []byte) (n int, err error) {
 func (c *Conn) Write(b []byte) (n int, err error) {
 	mu.Lock()
 	defer mu.Unlock()
+	return c.write(context.Background(), b)
+}
+
+// Like Write, but without copying s to a byte slice. libutp copies what it
+// accepts before utp_write returns, as does SetWriteCoalesce's buffer, so s
+// isn't referred to once WriteString returns.
+func (c *Conn) WriteString(s string) (int, error) {
+	var b []byte
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	bh.Data = sh.Data
+	bh.Len = sh.Len
+	bh.Cap = sh.Len
+	n, err := c.Write(b)
+	// b doesn't keep s's bytes alive by itself.
+	runtime.KeepAlive(s)
+	return n, err
+}
+
+// Like Write, but gives up if ctx is done while waiting for the send window,
+// returning the number of bytes accepted so far, and ctx's error.
+func (c *Conn) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	defer c.broadcastOnDone(ctx)()
+	return c.write(ctx, b)
+}
+
+// Writes each of bufs in turn while holding the lock once, like net.Buffers.
+// On error, n is the total number of bytes written from all of bufs.
+func (c *Conn) WriteBuffers(bufs [][]byte) (n int64, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, b := range bufs {
+		var n1 int
+		n1, err = c.write(context.Background(), b)
+		n += int64(n1)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Waits until b is written, or ctx is done. ctx must be watched with
+// broadcastOnDone if it can be done.
+func (c *Conn) write(ctx context.Context, b []byte) (n int, err error) {
+	if c.coalesceMaxBytes != 0 || len(c.coalesced) != 0 {
+		n, err = c.writeCoalescing(ctx, b)
+	} else {
+		n, err = c.writeAll(ctx, b)
+	}
+	c.addBytesWritten(int64(n))
+	if n < len(b) && err == nil {
+		// Both paths only stop early for an error, but io.Writer depends on
+		// it.
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+// Gives all of b to libutp, waiting for the send window and the write limit.
+func (c *Conn) writeAll(ctx context.Context, b []byte) (n int, err error) {
 	for len(b) != 0 {
+		wb := b
+		allowed := 0
+		if c.writeLimiter != nil {
+			var wait time.Duration
+			allowed, wait = c.writeLimiter.take(len(b), time.Now())
+			if allowed == 0 {
+				if err = c.writeErr(); err != nil {
+					break
+				}
+				if err = ctx.Err(); err != nil {
+					break
+				}
+				c.waitAtMost(wait)
+				continue
+			}
+			wb = b[:allowed]
+		}
 		var n1 int
-		n1, err = c.writeNoWait(b)
+		n1, err = c.writeNoWait(wb)
+		if allowed != 0 {
+			c.writeLimiter.giveBack(allowed - n1)
+		}
 		b = b[n1:]
 		n += n1
 		if err != nil {
@@ -199,25 +860,150 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 		if n1 != 0 {
 			continue
 		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
 		c.cond.Wait()
 	}
-	c.numBytesWritten += int64(n)
-	// log.Printf("wrote %d bytes", c.numBytesWritten)
 	return
 }
 
-func (c *Conn) setRemoteAddr() {
+// Implements io.WriterTo. Buffered data is handed to w directly, rather than
+// being copied through an intermediate buffer. Returns nil at EOF.
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	// The read callback writes into readBuf while we're writing to w, so we
+	// swap it out for another buffer each time.
+	spare := new(bytes.Buffer)
+	for {
+		mu.Lock()
+		for c.readBuf.Len() == 0 {
+			err = c.readErr()
+			if err != nil {
+				mu.Unlock()
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			c.cond.Wait()
+		}
+		spare.Reset()
+		c.readBuf, spare = spare, c.readBuf
+		c.addBytesRead(int64(spare.Len()))
+		if c.us != nil {
+			c.readDrained()
+		}
+		mu.Unlock()
+		var n1 int
+		n1, err = w.Write(spare.Bytes())
+		n += int64(n1)
+		if err != nil {
+			return
+		}
+	}
+}
+
+const copyBufferSize = 64 << 10
+
+// Implements io.ReaderFrom.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return c.copyFrom(r, make([]byte, copyBufferSize))
+}
+
+// Copies from r until EOF through a single buffer of bufSize bytes, so
+// memory use doesn't depend on how much is copied. A bufSize of zero uses
+// 64 KiB, as for ReadFrom. Each write is subject to the write deadline, so
+// the copy can be cancelled with SetWriteDeadline or Close. Returns nil at
+// EOF.
+func (c *Conn) CopyFrom(r io.Reader, bufSize int) (int64, error) {
+	if bufSize < 0 {
+		return 0, fmt.Errorf("negative buffer size: %d", bufSize)
+	}
+	if bufSize == 0 {
+		bufSize = copyBufferSize
+	}
+	return c.copyFrom(r, make([]byte, bufSize))
+}
+
+func (c *Conn) copyFrom(r io.Reader, buf []byte) (n int64, err error) {
+	for {
+		nr, rerr := r.Read(buf)
+		if nr != 0 {
+			var nw int
+			nw, err = c.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return
+		}
+		if rerr != nil {
+			err = rerr
+			return
+		}
+	}
+}
+
+func (c *Conn) setRemoteAddr() error {
 	var rsa syscall.RawSockaddrAny
 	var addrlen C.socklen_t = C.socklen_t(unsafe.Sizeof(rsa))
-	C.utp_getpeername(c.us, (*C.struct_sockaddr)(unsafe.Pointer(&rsa)), &addrlen)
+	if n := C.utp_getpeername(c.us, (*C.struct_sockaddr)(unsafe.Pointer(&rsa)), &addrlen); n != 0 {
+		return fmt.Errorf("utp_getpeername returned %d", n)
+	}
 	var udp net.UDPAddr
 	if err := anySockaddrToUdp(&rsa, &udp); err != nil {
-		panic(err)
+		return err
+	}
+	if rsa.Addr.Family == syscall.AF_INET6 {
+		udp.Zone = scopeIdToZone((*syscall.RawSockaddrInet6)(unsafe.Pointer(&rsa)).Scope_id)
 	}
 	c.remoteAddr = &udp
+	return nil
+}
+
+// Returns the Context passed to the Socket.AcceptContext call that returned
+// the Conn, so values can be associated with it by the server. It's
+// context.Background for Conns accepted otherwise, or dialed.
+func (c *Conn) Context() context.Context {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Sets a label for the Conn, such as a peer or request ID, to tell its log
+// messages apart from those of other Conns on the Socket. libutp's messages
+// for the Conn, including those passed to the SetLogger function, and this
+// package's, are prefixed with "[label] ". Empty removes it.
+func (c *Conn) SetLabel(label string) {
+	mu.Lock()
+	c.label = label
+	mu.Unlock()
 }
 
+func (c *Conn) Label() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.label
+}
+
+// Returns the prefix for log messages about c, which may be nil.
+func (c *Conn) logPrefix() string {
+	if c == nil || c.label == "" {
+		return ""
+	}
+	return "[" + c.label + "] "
+}
+
+// Returns the peer's address, determined when the Conn was connected or
+// accepted. It remains available after the Conn is destroyed.
 func (c *Conn) RemoteAddr() net.Addr {
+	mu.Lock()
+	defer mu.Unlock()
 	return c.remoteAddr
 }
 
@@ -226,13 +1012,11 @@ func (c *Conn) SetDeadline(t time.Time) error {
 	defer mu.Unlock()
 	c.readDeadline = t
 	c.writeDeadline = t
+	c.resetReadDeadlineTimer()
 	if t.IsZero() {
-		c.readDeadlineTimer.Stop()
 		c.writeDeadlineTimer.Stop()
 	} else {
-		d := t.Sub(time.Now())
-		c.readDeadlineTimer.Reset(d)
-		c.writeDeadlineTimer.Reset(d)
+		c.writeDeadlineTimer.Reset(t.Sub(time.Now()))
 	}
 	c.cond.Broadcast()
 	return nil
@@ -241,15 +1025,55 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 	mu.Lock()
 	defer mu.Unlock()
 	c.readDeadline = t
-	if t.IsZero() {
-		c.readDeadlineTimer.Stop()
+	c.resetReadDeadlineTimer()
+	c.cond.Broadcast()
+	return nil
+}
+
+// Sets a timeout for reads that's pushed back each time data is read, unlike
+// SetReadDeadline's fixed time. Reads fail with the same timeout error once
+// nothing has been read for d. If both are set, whichever is earlier applies.
+// Zero disables it.
+func (c *Conn) SetReadIdleTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative read idle timeout: %v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.readIdleTimeout = d
+	if d == 0 {
+		c.readIdleDeadline = time.Time{}
 	} else {
-		d := t.Sub(time.Now())
-		c.readDeadlineTimer.Reset(d)
+		c.readIdleDeadline = time.Now().Add(d)
 	}
+	c.resetReadDeadlineTimer()
 	c.cond.Broadcast()
 	return nil
 }
+
+// Returns the earlier of the read deadline and the read idle deadline, or the
+// zero time if neither is set.
+func (c *Conn) effectiveReadDeadline() time.Time {
+	t := c.readDeadline
+	if !c.readIdleDeadline.IsZero() && (t.IsZero() || c.readIdleDeadline.Before(t)) {
+		t = c.readIdleDeadline
+	}
+	return t
+}
+
+func (c *Conn) readDeadlineExceeded() bool {
+	t := c.effectiveReadDeadline()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (c *Conn) resetReadDeadlineTimer() {
+	t := c.effectiveReadDeadline()
+	if t.IsZero() {
+		c.readDeadlineTimer.Stop()
+	} else {
+		c.readDeadlineTimer.Reset(t.Sub(time.Now()))
+	}
+}
 func (c *Conn) SetWriteDeadline(t time.Time) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -266,13 +1090,57 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 
 func (c *Conn) setGotEOF() {
 	c.gotEOF = true
+	c.readableNotify.end()
 	c.cond.Broadcast()
+	c.s.noteReadable(c)
 }
 
 func (c *Conn) onDestroyed() {
+	counted := c.counted
+	if counted {
+		c.s.numConns--
+		c.counted = false
+	}
+	c.retransmits = int64(C.utp_get_retransmits(c.us))
+	c.s.destroyedRexmit += uint64(c.retransmits)
 	c.destroyed = true
+	c.closeClosedCh()
+	c.writableNotify.end()
+	c.readableNotify.end()
 	c.us = nil
+	c.coalesced = nil
+	if c.coalesceTimer != nil {
+		c.coalesceTimer.Stop()
+	}
 	c.cond.Broadcast()
+	c.s.noteReadable(c)
+	if onClose := c.s.onClose; counted && onClose != nil {
+		err := c.endErr()
+		mu.queueHook(func() { onClose(c, err) })
+	}
+	c.closeOwnedSocket()
+}
+
+// Why the Conn ended, for Socket.OnClose.
+func (c *Conn) endErr() error {
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.closed:
+		return ErrClosed
+	case c.gotEOF:
+		return io.EOF
+	default:
+		return ErrDestroyed
+	}
+}
+
+func (c *Conn) closeOwnedSocket() {
+	if c.ownsSocket {
+		// We're likely inside a libutp callback, which the Socket's
+		// utp_context must outlive.
+		go c.s.Close()
+	}
 }
 
 func (c *Conn) WriteBufferLen() int {
@@ -290,6 +1158,231 @@ func (c *Conn) SetWriteBufferLen(len int) {
 	}
 }
 
+// Has libutp send anything it's holding back for the Conn's Socket: deferred
+// acks, and packets due for (re)transmission. Written data is already sent as
+// soon as the send window allows, so this only schedules what congestion
+// control permits, and doesn't guarantee that anything is transmitted.
+func (c *Conn) Flush() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.s.closed {
+		return errSocketClosed
+	}
+	if c.us == nil {
+		return ErrDestroyed
+	}
+	c.flushCoalesced()
+	c.s.issueDeferredAcks()
+	c.s.checkUtpTimeouts()
+	return nil
+}
+
+// Sets the size of libutp's receive buffer for the Conn, which bounds the
+// receive window it advertises. libutp defaults this to 1 MiB.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	return c.SetOption(RecvBuffer, bytes)
+}
+
+// Caps the data received and not yet read that's held for the Conn, by
+// narrowing the receive window libutp advertises as the buffer fills, so a
+// slow reader holds up the peer instead of using more memory. The window is
+// reopened as reads consume the buffer. The buffer can overshoot the cap by
+// the packets in flight when it's reached. Zero, the default, leaves only
+// the limit from SetReadBuffer, whichever is smaller applying.
+func (c *Conn) SetMaxReceiveBuffer(bytes int) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid max receive buffer: %d", bytes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.maxReadBuf = bytes
+	return nil
+}
+
+// Sets the size of libutp's send buffer for the Conn, which bounds the amount
+// of unacknowledged data in flight. libutp defaults this to 1 MiB.
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	return c.SetOption(SendBuffer, bytes)
+}
+
+// Sets one of libutp's per-Conn options, for those without a method of
+// their own: SendBuffer, RecvBuffer, or TargetDelay in microseconds. Conns
+// take their initial values from the Socket's options. Other options are
+// Socket-wide, and are set with Socket.SetOption.
+func (c *Conn) SetOption(opt Option, val int) error {
+	if !isConnOption(opt) {
+		return fmt.Errorf("unsupported Conn option %d", opt)
+	}
+	if val <= 0 || val > math.MaxInt32 {
+		return fmt.Errorf("invalid value for option %d: %d", opt, val)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return ErrDestroyed
+	}
+	if i := C.utp_setsockopt(c.us, opt, C.int(val)); i != 0 {
+		return fmt.Errorf("utp_setsockopt returned %d", i)
+	}
+	return nil
+}
+
+// Returns the value of an option SetOption accepts.
+func (c *Conn) GetOption(opt Option) (int, error) {
+	if !isConnOption(opt) {
+		return 0, fmt.Errorf("unsupported Conn option %d", opt)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return 0, ErrDestroyed
+	}
+	return int(C.utp_getsockopt(c.us, opt)), nil
+}
+
+func isConnOption(opt Option) bool {
+	switch opt {
+	case SendBuffer, RecvBuffer, TargetDelay:
+		return true
+	}
+	return false
+}
+
+// Returns libutp's smoothed round trip time estimate, or 0 if there isn't one
+// yet. It's updated each time a packet that wasn't retransmitted is
+// acknowledged, and is only tracked to the millisecond.
+func (c *Conn) RTT() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return 0
+	}
+	return time.Duration(C.utp_get_rtt(c.us)) * time.Millisecond
+}
+
+// Returns how long a dialed Conn took to connect, from sending its SYN to
+// receiving the peer's reply, including any retransmits of the SYN. It's
+// zero until then, and for accepted Conns, for which the peer's SYN is the
+// whole handshake. It remains available after the Conn is destroyed.
+func (c *Conn) HandshakeDuration() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.handshakeDuration
+}
+
+// libutp's hardcoded KEEPALIVE_INTERVAL.
+const defaultKeepAlivePeriod = 29 * time.Second
+
+// Sets whether the Conn sends keep-alives after it has sent nothing for the
+// keep-alive period. They're enabled by default, every 29s, which keeps NAT
+// mappings alive on idle Conns. Disabling them lets idle Conns be forgotten by
+// NATs along the path, after which the peer's packets won't reach us, and
+// ours may be refused. libutp doesn't use keep-alives to detect dead peers.
+func (c *Conn) SetKeepAlive(enable bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+	c.keepAliveDisabled = !enable
+	return c.applyKeepAlive()
+}
+
+// Sets the period of inactivity after which keep-alives are sent, if they're
+// enabled. It's tracked to the millisecond.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if d < time.Millisecond || d/time.Millisecond > math.MaxUint32 {
+		return fmt.Errorf("keep-alive period out of range: %v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.keepAlivePeriod = d
+	return c.applyKeepAlive()
+}
+
+func (c *Conn) applyKeepAlive() error {
+	if c.us == nil {
+		return ErrDestroyed
+	}
+	var ms C.uint32
+	if !c.keepAliveDisabled {
+		d := c.keepAlivePeriod
+		if d == 0 {
+			d = defaultKeepAlivePeriod
+		}
+		ms = C.uint32(d / time.Millisecond)
+	}
+	C.utp_set_keepalive_interval(c.us, ms)
+	return nil
+}
+
+// Sets whether small writes are sent immediately. By default, like TCP's
+// Nagle algorithm, libutp holds back the last, partly filled packet while
+// others are unacknowledged, so that further writes can fill it. Enabling
+// no-delay sends it straight away, lowering the latency of small messages at
+// the cost of more, smaller packets, and so more overhead and less
+// throughput. libutp had no such flag, so it's added to our copy; enabling it
+// also sends any packet currently held back.
+func (c *Conn) SetNoDelay(enable bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return ErrDestroyed
+	}
+	var nodelay C.int
+	if enable {
+		nodelay = 1
+	}
+	C.utp_set_nodelay(c.us, nodelay)
+	return nil
+}
+
+// The highest weight SetPriority accepts.
+const MaxPriority = 16
+
+// Weights the Conn's share of the bandwidth it competes for with other Conns,
+// such as bulk transfers on the same Socket slowing control messages. libutp
+// has no scheduling across Conns, and each does its own congestion control,
+// so the weight multiplies how quickly the Conn's congestion window grows
+// and shrinks when queuing delay is under or over the target. Conns sharing
+// a bottleneck from the start tend towards windows in proportion to their
+// weights, but that's not guaranteed: one started later is at a
+// disadvantage, as with LEDBAT generally, and weights don't affect the
+// halving on loss. Higher weights are more aggressive, so more prone to loss
+// where buffers are shallow. weight is 1 by default, up to MaxPriority.
+func (c *Conn) SetPriority(weight int) error {
+	if weight < 1 || weight > MaxPriority {
+		return fmt.Errorf("priority weight %d out of range [1, %d]", weight, MaxPriority)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return ErrDestroyed
+	}
+	C.utp_set_weight(c.us, C.int(weight))
+	return nil
+}
+
+// Returns the number of bytes libutp will allow in flight: the congestion
+// window, limited by the send buffer and the peer's receive window. Returns 0
+// once the Conn is destroyed.
+func (c *Conn) SendWindow() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return 0
+	}
+	return int(C.utp_get_send_window(c.us))
+}
+
+// Returns the number of bytes sent that haven't been acknowledged. Write will
+// block once this would exceed SendWindow.
+func (c *Conn) BytesInFlight() int {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return 0
+	}
+	return int(C.utp_get_bytes_in_flight(c.us))
+}
+
 // Connect an unconnected Conn (obtained through Socket.NewConn).
 func (c *Conn) Connect(ctx context.Context, network, addr string) error {
 	if network == "" {
@@ -299,17 +1392,29 @@ func (c *Conn) Connect(ctx context.Context, network, addr string) error {
 	if err != nil {
 		return fmt.Errorf("error resolving address: %v", err)
 	}
+	return c.connect(ctx, ua)
+}
+
+func (c *Conn) connect(ctx context.Context, ua net.Addr) (err error) {
 	sa, sl := netAddrToLibSockaddr(ua)
 	mu.Lock()
 	defer mu.Unlock()
 	if c.s.closed {
 		return errSocketClosed
 	}
+	c.connectStarted = time.Now()
 	if n := C.utp_connect(c.us, (*C.struct_sockaddr)(unsafe.Pointer(&sa)), sl); n != 0 {
 		panic(n)
 	}
 	c.inited = true
-	c.setRemoteAddr()
+	if err := c.setRemoteAddr(); err != nil {
+		c.close()
+		return fmt.Errorf("getting peer address: %w", err)
+	}
+	if ua, ok := ua.(*net.UDPAddr); ok && ua.Zone != "" {
+		// libutp doesn't retain the IPv6 scope ID.
+		c.remoteAddr.(*net.UDPAddr).Zone = ua.Zone
+	}
 	err = c.waitForConnect(ctx)
 	if err != nil {
 		c.close()
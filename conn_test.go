@@ -1,9 +1,19 @@
 package utp
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/anacrolix/missinggo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,5 +34,1390 @@ func TestConnMethodsAfterClose(t *testing.T) {
 		// return.
 		assert.NotPanics(t, func() { c.RemoteAddr() })
 		assert.NotPanics(t, func() { c.LocalAddr() })
+		// The local address is cached when the Conn is created.
+		assert.Equal(t, s.Addr(), c.LocalAddr())
 	}
 }
+
+func TestConnStats(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	n, err := d.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, n)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, d.(*Conn).Stats().BytesWritten)
+	assert.EqualValues(t, 5, a.(*Conn).Stats().BytesRead)
+	// libutp's counters include headers and the handshake.
+	ds := d.(*Conn).Stats()
+	assert.NotZero(t, ds.Xmit)
+	assert.True(t, ds.BytesXmit > 5, ds.BytesXmit)
+	as := a.(*Conn).Stats()
+	assert.NotZero(t, as.Recv)
+	assert.True(t, as.BytesRecv > 5, as.BytesRecv)
+	assert.NoError(t, s.Close())
+	assert.NotPanics(t, func() { d.(*Conn).Stats() })
+}
+
+func TestConnSetBuffers(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Error(t, c.SetWriteBuffer(0))
+	assert.Error(t, c.SetReadBuffer(-1))
+	require.NoError(t, c.SetWriteBuffer(1<<16))
+	require.NoError(t, c.SetReadBuffer(1<<17))
+	assert.Equal(t, 1<<16, c.WriteBufferLen())
+}
+
+func TestConnSetOption(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	assert.Error(t, c.SetOption(LogDebug, 1))
+	_, err = c.GetOption(InitialWindow)
+	assert.Error(t, err)
+	assert.Error(t, c.SetOption(TargetDelay, 0))
+	require.NoError(t, c.SetOption(TargetDelay, 50000))
+	v, err := c.GetOption(TargetDelay)
+	require.NoError(t, err)
+	assert.Equal(t, 50000, v)
+	require.NoError(t, c.SetReadBuffer(1<<17))
+	v, err = c.GetOption(RecvBuffer)
+	require.NoError(t, err)
+	assert.Equal(t, 1<<17, v)
+	require.NoError(t, c.Close())
+	d, a := connPairSocket(s)
+	defer a.Close()
+	require.NoError(t, d.(*Conn).CloseSync())
+	assert.Equal(t, ErrDestroyed, d.(*Conn).SetOption(SendBuffer, 1<<16))
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, d.(*Conn).CloseWrite())
+	_, err = d.Write([]byte("more"))
+	assert.EqualError(t, err, "write closed")
+	b, err := ioutil.ReadAll(a)
+	require.NoError(t, err)
+	assert.EqualValues(t, "request", b)
+	_, err = a.Write([]byte("response"))
+	require.NoError(t, err)
+	b = make([]byte, len("response"))
+	_, err = io.ReadFull(d, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "response", b)
+}
+
+func TestConnCloseRead(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	require.NoError(t, a.(*Conn).CloseRead())
+	mu.Lock()
+	assert.Equal(t, 0, a.(*Conn).readBuf.Len())
+	mu.Unlock()
+	n, err := a.Read(b)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	// The write side is unaffected.
+	_, err = a.Write([]byte("world"))
+	require.NoError(t, err)
+	b = make([]byte, 5)
+	_, err = io.ReadFull(d, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "world", b)
+}
+
+func TestConnCloseWithTimeout(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	const n = 1 << 20
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, a, n)
+		readErr <- err
+	}()
+	_, err = d.Write(make([]byte, n))
+	require.NoError(t, err)
+	require.NoError(t, d.(*Conn).CloseWithTimeout(10*time.Second))
+	assert.Nil(t, d.(*Conn).us)
+	require.NoError(t, <-readErr)
+}
+
+func TestConnCloseSync(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, a, 1<<20)
+		readErr <- err
+	}()
+	_, err = d.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.NoError(t, d.(*Conn).CloseSync())
+	assert.True(t, d.(*Conn).destroyed)
+	require.NoError(t, <-readErr)
+	// It returns immediately once closed, or if never connected.
+	require.NoError(t, d.(*Conn).CloseSync())
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	require.NoError(t, c.CloseSync())
+}
+
+func TestConnCloseAfterDrain(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	_, err = d.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	read := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(a)
+		read <- b
+	}()
+	require.NoError(t, a.(*Conn).CloseAfterDrain())
+	assert.EqualValues(t, "response", <-read)
+	// The peer never closes, so only the deadline ends the wait.
+	d, a = connPairSocket(s)
+	defer d.Close()
+	go io.Copy(ioutil.Discard, a)
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	err = a.(*Conn).CloseAfterDrain()
+	assert.True(t, err.(net.Error).Timeout())
+	_, err = a.Write([]byte("x"))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestConnRTT(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.EqualValues(t, 0, c.RTT())
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	assert.True(t, d.(*Conn).RTT() >= 0)
+	assert.NoError(t, s.Close())
+	assert.EqualValues(t, 0, d.(*Conn).RTT())
+}
+
+func TestConnWriteToReadFrom(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	const n = 1 << 20
+	var received bytes.Buffer
+	copied := make(chan int64, 1)
+	go func() {
+		n, err := a.(*Conn).WriteTo(&received)
+		assert.NoError(t, err)
+		copied <- n
+	}()
+	wn, err := d.(*Conn).ReadFrom(io.LimitReader(missinggo.ZeroReader, n))
+	require.NoError(t, err)
+	assert.EqualValues(t, n, wn)
+	require.NoError(t, d.(*Conn).CloseWrite())
+	assert.EqualValues(t, n, <-copied)
+	assert.EqualValues(t, n, received.Len())
+	assert.EqualValues(t, n, d.(*Conn).Stats().BytesWritten)
+	assert.EqualValues(t, n, a.(*Conn).Stats().BytesRead)
+	d.Close()
+}
+
+// Records the largest buffer it's asked to fill.
+type maxReadReader struct {
+	io.Reader
+	max int
+}
+
+func (r *maxReadReader) Read(b []byte) (int, error) {
+	if len(b) > r.max {
+		r.max = len(b)
+	}
+	return r.Reader.Read(b)
+}
+
+func TestConnCopyFrom(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	_, err = dc.CopyFrom(missinggo.ZeroReader, -1)
+	assert.Error(t, err)
+	const n = 100 << 10
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, a)
+		received <- n
+	}()
+	r := &maxReadReader{Reader: io.LimitReader(missinggo.ZeroReader, n)}
+	wn, err := dc.CopyFrom(r, 1000)
+	require.NoError(t, err)
+	assert.EqualValues(t, n, wn)
+	assert.Equal(t, 1000, r.max)
+	r = &maxReadReader{Reader: io.LimitReader(missinggo.ZeroReader, n)}
+	_, err = dc.CopyFrom(r, 0)
+	require.NoError(t, err)
+	assert.Equal(t, copyBufferSize, r.max)
+	require.NoError(t, dc.CloseWrite())
+	assert.EqualValues(t, 2*n, <-received)
+}
+
+func TestConnCopyFromWriteDeadline(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	// Nothing reads from a, so the copy stalls once the windows fill.
+	require.NoError(t, d.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = d.(*Conn).CopyFrom(missinggo.ZeroReader, 4096)
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+}
+
+func TestConnSetMaxReceiveBuffer(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	assert.Error(t, ac.SetMaxReceiveBuffer(-1))
+	const max = 64 << 10
+	require.NoError(t, ac.SetMaxReceiveBuffer(max))
+	const n = 1 << 20
+	go d.Write(make([]byte, n))
+	// Nothing reads, so the buffer fills, and stops there.
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	buffered := ac.readBuf.Len()
+	mu.Unlock()
+	assert.True(t, buffered >= max/2, buffered)
+	assert.True(t, buffered <= max+16<<10, buffered)
+	_, err = io.CopyN(ioutil.Discard, a, n)
+	require.NoError(t, err)
+}
+
+func TestConnOptions(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.SetCongestionTarget(25*time.Millisecond))
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc := d.(*Conn)
+	require.NoError(t, dc.SetReadBuffer(1<<17))
+	opts := dc.Options()
+	assert.Equal(t, 1<<17, opts.RecvBuffer)
+	assert.Equal(t, 1<<20, opts.SendBuffer)
+	assert.Equal(t, 25*time.Millisecond, opts.CongestionTarget)
+	assert.NotZero(t, opts.PacketSize)
+	require.NoError(t, dc.CloseSync())
+	assert.Equal(t, ConnOptions{}, dc.Options())
+}
+
+func TestConnDelayInfo(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc, ac := d.(*Conn), a.(*Conn)
+	go io.Copy(ioutil.Discard, ac)
+	_, err = dc.Write(make([]byte, 1<<18))
+	require.NoError(t, err)
+	require.NoError(t, dc.Flush())
+	info := dc.DelayInfo()
+	assert.True(t, info.CurrentDelay >= 0)
+	assert.True(t, info.PeerDelay >= 0)
+	assert.True(t, info.Age >= 0)
+	// The target is 100ms by default, and loopback doesn't queue that much.
+	assert.True(t, info.OffTarget > 0, "%v", info.OffTarget)
+	require.NoError(t, dc.CloseSync())
+	assert.Equal(t, DelayInfo{}, dc.DelayInfo())
+}
+
+func TestConnAckStats(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc, ac := d.(*Conn), a.(*Conn)
+	_, err = d.Write(make([]byte, 1<<16))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, make([]byte, 1<<16))
+	require.NoError(t, err)
+	stats := ac.AckStats()
+	assert.NotZero(t, stats.DeferredAcks)
+	assert.True(t, stats.DeferredAcks <= stats.AcksSent)
+	assert.True(t, stats.LastAckDelay < time.Second, "%v", stats.LastAckDelay)
+	// Replies carry the acks for what they answer.
+	for i := 0; i < 10; i++ {
+		_, err = d.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(a, make([]byte, 4))
+		require.NoError(t, err)
+		_, err = a.Write([]byte("pong"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(d, make([]byte, 4))
+		require.NoError(t, err)
+	}
+	stats = ac.AckStats()
+	assert.True(t, stats.AcksSent+stats.PiggybackedAcks >= 10)
+	require.NoError(t, dc.CloseSync())
+	assert.Equal(t, AckStats{}, dc.AckStats())
+}
+
+func TestConnReadVectored(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ac := a.(*Conn)
+	n, stopped, err := ac.ReadVectored(nil)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Zero(t, stopped)
+	_, err = d.Write([]byte("headbody"))
+	require.NoError(t, err)
+	for ac.Buffered() < 8 {
+		time.Sleep(time.Millisecond)
+	}
+	head := make([]byte, 4)
+	body := make([]byte, 10)
+	n, stopped, err = ac.ReadVectored([][]byte{head, nil, body})
+	require.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 2, stopped)
+	assert.EqualValues(t, "head", head)
+	assert.EqualValues(t, "body", body[:4])
+	_, err = d.Write([]byte("abcd"))
+	require.NoError(t, err)
+	n, stopped, err = ac.ReadVectored([][]byte{head[:2], head[2:]})
+	require.NoError(t, err)
+	if n == 4 {
+		assert.Equal(t, 2, stopped)
+	}
+	assert.EqualValues(t, "abcd"[:n], head[:n])
+	assert.EqualValues(t, 8+n, ac.Stats().BytesRead)
+	require.NoError(t, d.Close())
+	for {
+		_, _, err = ac.ReadVectored([][]byte{head})
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestConnHandshakeDuration(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Zero(t, c.HandshakeDuration())
+	started := time.Now()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	hd := d.(*Conn).HandshakeDuration()
+	assert.True(t, hd > 0)
+	assert.True(t, hd <= time.Since(started))
+	assert.Zero(t, a.(*Conn).HandshakeDuration())
+	require.NoError(t, d.(*Conn).CloseSync())
+	assert.Equal(t, hd, d.(*Conn).HandshakeDuration())
+}
+
+func TestRemoteAddrIPv6(t *testing.T) {
+	s, err := NewSocket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("error creating IPv6 socket: %s", err)
+	}
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	for _, c := range []net.Conn{d, a} {
+		ra := c.RemoteAddr().(*net.UDPAddr)
+		assert.Len(t, ra.IP, net.IPv6len)
+		assert.NotNil(t, ra.IP.To16())
+		assert.Nil(t, ra.IP.To4())
+		assert.True(t, ra.IP.Equal(net.IPv6loopback))
+		assert.Equal(t, s.Addr().(*net.UDPAddr).Port, ra.Port)
+	}
+}
+
+func TestRemoteAddrDuringConnect(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		c.Connect(ctx, "", neverResponds)
+	}()
+	for {
+		select {
+		case <-connected:
+			assert.NotNil(t, c.RemoteAddr())
+			return
+		default:
+			c.RemoteAddr()
+		}
+	}
+}
+
+func TestConnAddrsAfterDestroyed(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ra := d.RemoteAddr()
+	require.NoError(t, d.(*Conn).CloseWithTimeout(5*time.Second))
+	mu.Lock()
+	require.True(t, d.(*Conn).destroyed)
+	mu.Unlock()
+	assert.NotPanics(t, func() {
+		assert.Equal(t, ra, d.RemoteAddr())
+		assert.Equal(t, s.Addr(), d.LocalAddr())
+	})
+}
+
+func TestConnBufferedPeek(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	assert.Equal(t, 0, ac.Buffered())
+	_, err = ac.Peek(-1)
+	assert.Equal(t, errNegativeCount, err)
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = ac.Peek(1)
+	assert.Equal(t, errDeadlineExceededValue, err)
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	b, err := ac.Peek(3)
+	require.NoError(t, err)
+	assert.EqualValues(t, "hel", b)
+	_, err = ac.Peek(-1)
+	assert.Equal(t, errNegativeCount, err)
+	for ac.Buffered() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	b = make([]byte, 5)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "hello", b)
+	assert.Equal(t, 0, ac.Buffered())
+}
+
+func TestConnWriteBuffers(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	n, err := d.(*Conn).WriteBuffers([][]byte{[]byte("head"), nil, []byte("er"), []byte("body")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, n)
+	b := make([]byte, 10)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "headerbody", b)
+	// A deadline interrupting the sequence reports the partial progress.
+	require.NoError(t, d.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	bufs := make([][]byte, 64)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1<<16)
+	}
+	n, err = d.(*Conn).WriteBuffers(bufs)
+	assert.Equal(t, errDeadlineExceededValue, err)
+	assert.True(t, n < 64<<16)
+	assert.EqualValues(t, 10+n, d.(*Conn).Stats().BytesWritten)
+}
+
+func TestConnReadBuffer(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	const n = 1 << 20
+	go func() {
+		d.Write(make([]byte, n))
+		d.Close()
+	}()
+	ac := a.(*Conn)
+	read := 0
+	for {
+		b, err := ac.ReadBuffer()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NotEmpty(t, b)
+		read += len(b)
+	}
+	assert.Equal(t, n, read)
+	assert.EqualValues(t, n, ac.Stats().BytesRead)
+}
+
+func TestConnReadPooled(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ac := a.(*Conn)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	b, release, err := ac.ReadPooled()
+	require.NoError(t, err)
+	// It's unaffected by later reads until it's released.
+	_, err = d.Write([]byte("world"))
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(io.LimitReader(a, 5))
+	require.NoError(t, err)
+	assert.EqualValues(t, "world", got)
+	assert.EqualValues(t, "hello", b)
+	release()
+	// Releasing again doesn't put the buffer in the pool twice.
+	release()
+	require.NoError(t, d.Close())
+	b, release, err = ac.ReadPooled()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, b)
+	assert.Nil(t, release)
+	assert.EqualValues(t, 10, ac.Stats().BytesRead)
+}
+
+func TestConnFlush(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, d.(*Conn).Flush())
+	b := make([]byte, 7)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	assert.Equal(t, errSocketClosed, d.(*Conn).Flush())
+}
+
+func TestConnTryRead(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	b := make([]byte, 5)
+	n, err := ac.TryRead(b)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrWouldBlock, err)
+	assert.True(t, err.(net.Error).Temporary())
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	for ac.Buffered() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	n, err = ac.TryRead(b)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, d.Close())
+	for {
+		_, err = ac.TryRead(b)
+		if err != ErrWouldBlock {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestConnTryWrite(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	b := make([]byte, 1<<16)
+	var written int64
+	for {
+		n, err := dc.TryWrite(b)
+		written += int64(n)
+		if err == ErrWouldBlock {
+			assert.Equal(t, 0, n)
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.NotZero(t, written)
+	assert.Equal(t, written, dc.Stats().BytesWritten)
+	require.NoError(t, dc.CloseWrite())
+	_, err = dc.TryWrite(b)
+	assert.Equal(t, errWriteClosed, err)
+}
+
+func TestConnSendWindow(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, 0, c.BytesInFlight())
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	assert.NotZero(t, dc.SendWindow())
+	b := make([]byte, 1<<16)
+	for {
+		_, err := dc.TryWrite(b)
+		if err == ErrWouldBlock {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.NotZero(t, dc.BytesInFlight())
+	assert.NoError(t, s.Close())
+	assert.Equal(t, 0, dc.SendWindow())
+	assert.Equal(t, 0, dc.BytesInFlight())
+}
+
+func TestConnWriteAfterLibError(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	libErr := errorForCode(TimedOut)
+	mu.Lock()
+	d.(*Conn).onError(libErr)
+	mu.Unlock()
+	var n int
+	assert.NotPanics(t, func() { n, err = d.Write([]byte("hello")) })
+	assert.Equal(t, 0, n)
+	assert.Equal(t, libErr, err)
+	assert.NotPanics(t, func() { n, err = d.(*Conn).TryWrite([]byte("hello")) })
+	assert.Equal(t, libErr, err)
+}
+
+func TestConnWriteEmpty(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	for _, b := range [][]byte{nil, {}} {
+		var n int
+		require.NotPanics(t, func() { n, err = d.Write(b) })
+		assert.Equal(t, 0, n)
+		assert.NoError(t, err)
+		require.NotPanics(t, func() { n, err = dc.TryWrite(b) })
+		assert.Equal(t, 0, n)
+		assert.NoError(t, err)
+	}
+	var n64 int64
+	require.NotPanics(t, func() { n64, err = dc.WriteBuffers([][]byte{nil, {}, []byte("hi"), {}}) })
+	assert.EqualValues(t, 2, n64)
+	assert.NoError(t, err)
+	mu.Lock()
+	n, err := dc.writeNoWait(nil)
+	mu.Unlock()
+	assert.Equal(t, 0, n)
+	assert.NoError(t, err)
+}
+
+func TestConnKeepAlive(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	assert.Error(t, dc.SetKeepAlivePeriod(0))
+	keepAlives := 0
+	s.OnOverheadStatistics(func(conn *Conn, direction, bytes, overheadType int) {
+		if conn == dc && direction == OverheadSent && overheadType == OverheadAckType {
+			keepAlives++
+		}
+	})
+	require.NoError(t, dc.SetKeepAlivePeriod(time.Millisecond))
+	// Timeouts, and so keep-alives, are only checked periodically.
+	time.Sleep(3 * utpCheckTimeoutInterval)
+	mu.Lock()
+	assert.NotZero(t, keepAlives)
+	mu.Unlock()
+	require.NoError(t, dc.SetKeepAlive(false))
+	mu.Lock()
+	keepAlives = 0
+	mu.Unlock()
+	time.Sleep(3 * utpCheckTimeoutInterval)
+	mu.Lock()
+	assert.Zero(t, keepAlives)
+	mu.Unlock()
+	require.NoError(t, s.Close())
+	assert.Equal(t, ErrDestroyed, dc.SetKeepAlive(true))
+}
+
+func TestConnReadContext(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	n, err := ac.ReadContext(ctx, make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, context.Canceled, err)
+	_, err = ac.ReadContext(ctx, make([]byte, 1))
+	assert.Equal(t, context.Canceled, err)
+	// Data is still returned once it's there.
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	n, err = ac.ReadContext(context.Background(), b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "hello"[:n], b[:n])
+}
+
+func TestConnWriteContext(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// Nothing reads from a, so this fills the send and receive windows.
+	const size = 16 << 20
+	n, err := dc.WriteContext(ctx, make([]byte, size))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, n > 0 && n < size, n)
+	assert.EqualValues(t, n, dc.Stats().BytesWritten)
+}
+
+func TestConnClosedErrors(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	require.NoError(t, d.Close())
+	_, err = d.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+	_, err = d.Write([]byte("hello"))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+	// Still closed, rather than destroyed, once libutp is done with it.
+	require.NoError(t, s.Close())
+	_, err = d.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+	// a wasn't closed by the user.
+	_, err = a.Write([]byte("hello"))
+	assert.Equal(t, ErrDestroyed, err)
+}
+
+// A reset after the peer's FIN is reported over the EOF.
+func TestConnResetAfterEOF(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	ac := a.(*Conn)
+	require.NoError(t, ac.CloseWrite())
+	_, err = d.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, ac.Reset())
+	dc := d.(*Conn)
+	for dc.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = d.Read(make([]byte, 1))
+	assert.Equal(t, ErrConnReset, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestConnMultipleLibErrors(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	mu.Lock()
+	require.NotPanics(t, func() {
+		s.onLibError(dc.us, ErrConnReset)
+		s.onLibError(dc.us, ErrTimedOut)
+		s.onLibError(nil, ErrTimedOut)
+	})
+	mu.Unlock()
+	_, err = d.Read(make([]byte, 1))
+	assert.Equal(t, ErrConnReset, err)
+	_, err = d.Write([]byte("hello"))
+	assert.Equal(t, ErrConnReset, err)
+	assert.NotNil(t, d.RemoteAddr())
+	dc.Stats()
+}
+
+func TestConnBindContext(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	d.(*Conn).BindContext(ctx)
+	cancel()
+	_, err = d.Read(make([]byte, 1))
+	assert.Equal(t, ErrClosed, err)
+	// The watcher goes away if the Conn is closed first.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	goroutines := runtime.NumGoroutine()
+	a.(*Conn).BindContext(ctx)
+	require.NoError(t, a.Close())
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+}
+
+// The watcher also goes away if the Conn is destroyed without being closed,
+// as by closing its Socket.
+func TestConnBindContextDestroyed(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.(*Conn).BindContext(ctx)
+	require.NoError(t, s.Close())
+	select {
+	case <-a.(*Conn).closedCh:
+	case <-time.After(time.Second):
+		t.Fatal("watcher not stopped")
+	}
+	// Closing it after isn't a double close.
+	require.NoError(t, a.Close())
+}
+
+func TestConnReadIdleTimeout(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	assert.Error(t, ac.SetReadIdleTimeout(-1))
+	const idle = 200 * time.Millisecond
+	require.NoError(t, ac.SetReadIdleTimeout(idle))
+	go func() {
+		for i := 0; i < 5; i++ {
+			d.Write([]byte{byte(i)})
+			time.Sleep(idle / 4)
+		}
+	}()
+	started := time.Now()
+	b := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		_, err := io.ReadFull(a, b)
+		require.NoError(t, err)
+	}
+	// That took longer than idle, but data kept arriving.
+	assert.True(t, time.Since(started) > idle)
+	_, err = a.Read(b)
+	assert.Equal(t, errDeadlineExceededValue, err)
+	// The earlier deadline wins.
+	require.NoError(t, ac.SetReadIdleTimeout(time.Hour))
+	started = time.Now()
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = a.Read(b)
+	assert.Equal(t, errDeadlineExceededValue, err)
+	assert.True(t, time.Since(started) < time.Hour/2)
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+	require.NoError(t, ac.SetReadIdleTimeout(0))
+	_, err = d.Write([]byte("x"))
+	require.NoError(t, err)
+	_, err = a.Read(b)
+	assert.NoError(t, err)
+}
+
+func TestConnReadDeadlineWakesIdleRead(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	for i := 0; i < 10; i++ {
+		started := time.Now()
+		require.NoError(t, a.SetReadDeadline(started.Add(50*time.Millisecond)))
+		_, err = a.Read(make([]byte, 1))
+		took := time.Since(started)
+		assert.Equal(t, errDeadlineExceededValue, err)
+		assert.True(t, took >= 50*time.Millisecond, took)
+		assert.True(t, took < 150*time.Millisecond, took)
+	}
+}
+
+// Hammer SetReadDeadline while reads are blocked, and check the last deadline
+// set is still honoured.
+func TestConnSetReadDeadlineStress(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		b := make([]byte, 1)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := a.Read(b)
+			if err != errDeadlineExceededValue {
+				t.Errorf("unexpected read error: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		a.SetReadDeadline(time.Now().Add(time.Duration(i%5) * time.Millisecond))
+	}
+	close(stop)
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	select {
+	case <-readerDone:
+	case <-time.After(time.Second):
+		t.Fatal("read missed its deadline")
+	}
+}
+
+// Data buffered before EOF arrives is still returned, and EOF only once it's
+// been read.
+func TestConnReadDataThenEOF(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ac := a.(*Conn)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	mu.Lock()
+	for !ac.gotEOF {
+		ac.cond.Wait()
+	}
+	mu.Unlock()
+	b := make([]byte, 3)
+	n, err := a.Read(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hel", b[:n])
+	n, err = a.Read(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "lo", b[:n])
+	n, err = a.Read(b)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+// Counts the uTP data packets written through it, and drops everything once
+// dropping is set. Accessed under mu, as it's written to from libutp's sendto
+// callback.
+type dataCountingPacketConn struct {
+	net.PacketConn
+	dropping bool
+	dataSent int
+}
+
+func (pc *dataCountingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// ST_DATA, version 1.
+	if len(b) != 0 && b[0] == 0x01 {
+		pc.dataSent++
+	}
+	if pc.dropping {
+		return len(b), nil
+	}
+	return pc.PacketConn.WriteTo(b, addr)
+}
+
+func TestConnSetPriority(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	// Returns the largest send window seen while transferring.
+	maxSendWindow := func(weight int) (max int) {
+		d, a := connPairSocket(s)
+		defer d.Close()
+		defer a.Close()
+		dc := d.(*Conn)
+		assert.Error(t, dc.SetPriority(0))
+		assert.Error(t, dc.SetPriority(MaxPriority+1))
+		require.NoError(t, dc.SetPriority(weight))
+		go d.Write(make([]byte, 256<<10))
+		b := make([]byte, 4<<10)
+		for i := 0; i < 64; i++ {
+			_, err := io.ReadFull(a, b)
+			require.NoError(t, err)
+			if w := dc.SendWindow(); w > max {
+				max = w
+			}
+		}
+		return
+	}
+	// The same data grows the weighted Conn's window further.
+	unweighted := maxSendWindow(1)
+	weighted := maxSendWindow(MaxPriority)
+	assert.True(t, weighted > unweighted, "%d <= %d", weighted, unweighted)
+	d, a := connPairSocket(s)
+	defer a.Close()
+	require.NoError(t, d.(*Conn).CloseSync())
+	assert.Equal(t, ErrDestroyed, d.(*Conn).SetPriority(2))
+}
+
+func TestConnSetNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		pc, err := net.ListenPacket("udp", "localhost:0")
+		require.NoError(t, err)
+		cpc := &dataCountingPacketConn{PacketConn: pc}
+		s, err := NewSocketFromPacketConn(cpc)
+		require.NoError(t, err)
+		s.SetClosesPacketConn(true)
+		d, a := connPairSocket(s)
+		dc := d.(*Conn)
+		require.NoError(t, dc.SetNoDelay(noDelay))
+		// Open up the congestion window, so that it doesn't hold back the
+		// packets instead.
+		go func() {
+			d.Write(make([]byte, 1<<20))
+		}()
+		_, err = io.CopyN(ioutil.Discard, a, 1<<20)
+		require.NoError(t, err)
+		for dc.BytesInFlight() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// With nothing acknowledged, the second packet is only sent
+		// straight away without the Nagle check.
+		mu.Lock()
+		cpc.dropping = true
+		cpc.dataSent = 0
+		mu.Unlock()
+		_, err = d.Write([]byte("a"))
+		require.NoError(t, err)
+		_, err = d.Write([]byte("b"))
+		require.NoError(t, err)
+		mu.Lock()
+		if noDelay {
+			assert.Equal(t, 2, cpc.dataSent)
+		} else {
+			assert.Equal(t, 1, cpc.dataSent)
+		}
+		mu.Unlock()
+		a.Close()
+		d.Close()
+		require.NoError(t, s.Close())
+		assert.Equal(t, ErrDestroyed, dc.SetNoDelay(true))
+	}
+}
+
+func TestConnWritePartialDeadline(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	// Nothing is read, so the peer's receive window fills, and then our
+	// send window.
+	const timeout = 200 * time.Millisecond
+	started := time.Now()
+	require.NoError(t, d.SetWriteDeadline(started.Add(timeout)))
+	b := make([]byte, 16<<20)
+	n, err := d.Write(b)
+	assert.True(t, time.Since(started) >= timeout)
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.NotZero(t, n)
+	assert.True(t, n < len(b))
+	assert.EqualValues(t, n, d.(*Conn).Stats().BytesWritten)
+	// Further writes fail straight away without writing anything.
+	n1, err := d.Write(b[:1])
+	assert.Zero(t, n1)
+	assert.True(t, err.(net.Error).Timeout())
+	// Exactly what was reported written arrives.
+	_, err = io.ReadFull(a, make([]byte, n))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	n2, err := io.Copy(ioutil.Discard, a)
+	require.NoError(t, err)
+	assert.Zero(t, n2)
+}
+
+// Successful writes report exactly len(b), whichever way they're made.
+func TestConnWriteFull(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	go io.Copy(ioutil.Discard, a)
+	// Larger than the send window, so the write waits part way.
+	b := make([]byte, 4<<20)
+	n, err := d.Write(b)
+	assert.NoError(t, err)
+	assert.Equal(t, len(b), n)
+	n, err = d.Write(nil)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	require.NoError(t, dc.SetWriteLimit(1<<20))
+	n, err = d.Write(b[:100<<10])
+	assert.NoError(t, err)
+	assert.Equal(t, 100<<10, n)
+	require.NoError(t, dc.SetWriteLimit(0))
+	require.NoError(t, dc.SetWriteCoalesce(time.Millisecond, 1000))
+	for _, l := range []int{10, 999, 1000, 5000} {
+		n, err = d.Write(b[:l])
+		assert.NoError(t, err)
+		assert.Equal(t, l, n)
+	}
+}
+
+func TestConnRetransmits(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	cpc := &dataCountingPacketConn{PacketConn: pc}
+	s, err := NewSocketFromPacketConn(cpc)
+	require.NoError(t, err)
+	s.SetClosesPacketConn(true)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	assert.Zero(t, dc.Retransmits())
+	mu.Lock()
+	cpc.dropping = true
+	mu.Unlock()
+	_, err = d.Write([]byte("a"))
+	require.NoError(t, err)
+	// The packet's resent once the retransmission timeout expires.
+	for dc.Retransmits() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	cpc.dropping = false
+	mu.Unlock()
+	_, err = io.ReadFull(a, make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	assert.NotZero(t, dc.Retransmits())
+}
+
+func TestConnReset(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	ac := a.(*Conn)
+	require.NoError(t, ac.Reset())
+	_, err = d.Read(make([]byte, 1))
+	assert.Equal(t, ErrConnReset, err)
+	_, err = d.Write([]byte("x"))
+	assert.Equal(t, ErrConnReset, err)
+	_, err = a.Read(make([]byte, 1))
+	assert.Equal(t, ErrClosed, err)
+	_, err = a.Write([]byte("x"))
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, ac.Reset())
+	// There's nothing to linger for.
+	mu.Lock()
+	for !ac.destroyed {
+		ac.cond.Wait()
+	}
+	mu.Unlock()
+	// A Conn that never connected has nothing to tell a peer.
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	require.NoError(t, c.Reset())
+	assert.Equal(t, ErrClosed, c.Reset())
+}
+
+func TestConnReadFull(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ac := a.(*Conn)
+	go func() {
+		for _, b := range []string{"he", "ll", "o"} {
+			d.Write([]byte(b))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	b := make([]byte, 5)
+	n, err := ac.ReadFull(b)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "hello", string(b))
+
+	// A deadline part way through reports what was read.
+	_, err = d.Write([]byte("ab"))
+	require.NoError(t, err)
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	n, err = ac.ReadFull(b)
+	assert.Equal(t, 2, n)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.Equal(t, "ab", string(b[:n]))
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+
+	// As does EOF.
+	_, err = d.Write([]byte("xyz"))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	n, err = ac.ReadFull(b)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "xyz", string(b[:n]))
+	n, err = ac.ReadFull(b)
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestConnWriteString(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	var _ io.StringWriter = dc
+	n, err := dc.WriteString("hello")
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	n, err = dc.WriteString("")
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	msg := strings.Repeat("x", 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		dc.WriteString(msg)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestZoneScopeIds(t *testing.T) {
+	ifis, err := net.Interfaces()
+	require.NoError(t, err)
+	if len(ifis) == 0 {
+		t.Skip("no interfaces")
+	}
+	ifi := ifis[0]
+	id := uint32(ifi.Index)
+	assert.Equal(t, ifi.Name, scopeIdToZone(id))
+	assert.Equal(t, strconv.Itoa(ifi.Index), scopeIdToNumericZone(id))
+	assert.Equal(t, id, zoneToScopeId(ifi.Name))
+	assert.Equal(t, id, zoneToScopeId(ifi.Name))
+	assert.Equal(t, id, zoneToScopeId(scopeIdToNumericZone(id)))
+	assert.Empty(t, scopeIdToNumericZone(0))
+	assert.EqualValues(t, 0, zoneToScopeId(""))
+}
@@ -1,11 +1,17 @@
 package utp
 
-import "net"
+import (
+	"net"
+	"os"
+)
 
 type errDeadlineExceeded struct{}
 
 var _ net.Error = errDeadlineExceeded{}
 
 func (errDeadlineExceeded) Error() string   { return "deadline exceeded" }
-func (errDeadlineExceeded) Temporary() bool { return false }
+func (errDeadlineExceeded) Temporary() bool { return true }
 func (errDeadlineExceeded) Timeout() bool   { return true }
+
+// Allows errors.Is(err, os.ErrDeadlineExceeded), as for the standard library's net.Conns.
+func (errDeadlineExceeded) Is(target error) bool { return target == os.ErrDeadlineExceeded }
@@ -0,0 +1,145 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadlineExceededIsNetError(t *testing.T) {
+	var err error = errDeadlineExceededValue
+	ne, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, ne.Timeout())
+	assert.True(t, ne.Temporary())
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestReadWriteDeadlineErrorsMatch(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	require.NoError(t, d.SetDeadline(time.Now()))
+	_, readErr := d.Read(make([]byte, 1))
+	_, writeErr := d.Write(make([]byte, 1))
+	assert.True(t, errors.Is(readErr, os.ErrDeadlineExceeded))
+	assert.Equal(t, readErr, writeErr)
+}
+
+// The deadline is absolute, and applies to every Read until it's changed,
+// including ones made after it passed with no Read waiting for the timer.
+func TestReadDeadlinePersistsAcrossReads(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("ab"))
+	require.NoError(t, err)
+	const timeout = 50 * time.Millisecond
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(timeout)))
+	b := make([]byte, 1)
+	for _, want := range "ab" {
+		_, err = io.ReadFull(a, b)
+		require.NoError(t, err)
+		assert.EqualValues(t, want, b[0])
+	}
+	time.Sleep(2 * timeout)
+	for i := 0; i < 2; i++ {
+		started := time.Now()
+		_, err = a.Read(b)
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+		assert.True(t, time.Since(started) < timeout)
+	}
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+	_, err = d.Write([]byte("c"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, 'c', b[0])
+}
+
+// How late a parked operation may return after its deadline.
+const deadlineSlack = 50 * time.Millisecond
+
+func assertWokeAtDeadline(t *testing.T, err error, started time.Time, timeout time.Duration) {
+	took := time.Since(started)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "%v", err)
+	assert.True(t, took >= timeout, took)
+	assert.True(t, took < timeout+deadlineSlack, took)
+}
+
+func TestWriteDeadlineWakesBlockedWrite(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	const timeout = 100 * time.Millisecond
+	started := time.Now()
+	require.NoError(t, d.SetWriteDeadline(started.Add(timeout)))
+	// Nothing reads, so this fills the buffers and then waits.
+	_, err = d.Write(make([]byte, 8<<20))
+	assertWokeAtDeadline(t, err, started, timeout)
+}
+
+// Changing the deadline of a parked operation takes effect without waiting
+// for the previous deadline, in either direction.
+func TestDeadlineChangedWhileParked(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	const timeout = 100 * time.Millisecond
+	started := time.Now()
+	require.NoError(t, a.SetReadDeadline(started.Add(time.Hour)))
+	time.AfterFunc(timeout/2, func() {
+		a.SetReadDeadline(started.Add(timeout))
+	})
+	_, err = a.Read(make([]byte, 1))
+	assertWokeAtDeadline(t, err, started, timeout)
+	started = time.Now()
+	require.NoError(t, a.SetReadDeadline(started.Add(timeout/2)))
+	time.AfterFunc(timeout/4, func() {
+		a.SetReadDeadline(started.Add(timeout))
+	})
+	_, err = a.Read(make([]byte, 1))
+	assertWokeAtDeadline(t, err, started, timeout)
+}
+
+// Every way of waiting to read honours the read deadline.
+func TestReadDeadlineWakesParkedReaders(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	ac := a.(*Conn)
+	const timeout = 50 * time.Millisecond
+	for _, f := range []func() error{
+		func() error { _, err := ac.Peek(1); return err },
+		func() error { _, err := ac.ReadBuffer(); return err },
+		func() error { _, _, err := ac.ReadPooled(); return err },
+		func() error { _, _, err := ac.ReadVectored([][]byte{make([]byte, 1)}); return err },
+		func() error { _, err := ac.WriteTo(ioutil.Discard); return err },
+	} {
+		started := time.Now()
+		require.NoError(t, a.SetReadDeadline(started.Add(timeout)))
+		assertWokeAtDeadline(t, f(), started, timeout)
+	}
+}
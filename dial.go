@@ -0,0 +1,203 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Dials addr from a new Socket bound to laddr, so that the local interface
+// and port can be chosen. laddr may be nil to bind to any address. The Socket
+// is closed when the returned Conn is destroyed.
+func DialUDPContext(ctx context.Context, network string, laddr *net.UDPAddr, addr string) (*Conn, error) {
+	if network == "" {
+		network = "udp"
+	}
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	} else if !addrFamiliesMatch(laddr.IP, raddr.IP) {
+		return nil, errors.New("local and remote address families differ")
+	}
+	s, err := NewSocket(network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.NewConn()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	mu.Lock()
+	c.ownsSocket = true
+	mu.Unlock()
+	err = c.Connect(ctx, network, raddr.String())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dials addr from a new Socket, like net.DialTimeout. The error returned if
+// the timeout expires satisfies net.Error. A zero timeout means no timeout.
+func DialTimeout(network, addr string, timeout time.Duration) (*Conn, error) {
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return DialUDPContext(ctx, network, nil, addr)
+}
+
+// An unspecified local IP matches any remote family.
+func addrFamiliesMatch(local, remote net.IP) bool {
+	if local == nil || local.IsUnspecified() {
+		return true
+	}
+	return (local.To4() == nil) == (remote.To4() == nil)
+}
+
+// Dials uTP like net.Dialer dials TCP, so it can be used wherever a
+// net.Dialer's DialContext is, such as http.Transport.DialContext. Each Conn
+// gets its own Socket, as from DialUDPContext. The zero value is usable.
+type Dialer struct {
+	// The maximum time a dial will wait for the connection to be
+	// established. Zero means no timeout.
+	Timeout time.Duration
+	// The time after which dials fail. If Timeout is also set, the earlier
+	// of the two applies. Zero means no deadline.
+	Deadline time.Time
+	// The address to dial from. It must be a *net.UDPAddr, or nil to bind
+	// to any address.
+	LocalAddr net.Addr
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// Dials addr, which must be a host and port. network may be "udp", "udp4" or
+// "udp6", or the TCP equivalents, which are treated the same, so that the
+// Dialer can stand in for one dialing TCP.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	case "tcp", "tcp4", "tcp6":
+		network = "udp" + network[3:]
+	default:
+		return nil, fmt.Errorf("unsupported network: %q", network)
+	}
+	var laddr *net.UDPAddr
+	if d.LocalAddr != nil {
+		var ok bool
+		laddr, ok = d.LocalAddr.(*net.UDPAddr)
+		if !ok {
+			return nil, fmt.Errorf("local address is not a *net.UDPAddr: %v", d.LocalAddr)
+		}
+	}
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+	c, err := DialUDPContext(ctx, network, laddr, addr)
+	if err != nil {
+		// Don't return a typed nil.
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dials each of addrs concurrently, as with DialUDPContext, and returns the
+// first Conn to connect. The other dials are cancelled, and any that
+// connected anyway are closed, before it returns. If they all fail, the error
+// lists each address's error, and unwraps to the first address's.
+func DialMulti(ctx context.Context, network string, addrs []string) (*Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i   int
+		c   *Conn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	for i, addr := range addrs {
+		i, addr := i, addr
+		go func() {
+			c, err := DialUDPContext(ctx, network, nil, addr)
+			results <- result{i, c, err}
+		}()
+	}
+	var winner *Conn
+	errs := make(dialMultiError, len(addrs))
+	for range addrs {
+		r := <-results
+		switch {
+		case r.err != nil:
+			errs[r.i] = fmt.Errorf("%s: %w", addrs[r.i], r.err)
+		case winner == nil:
+			winner = r.c
+			cancel()
+		default:
+			// It connected before it saw the cancel.
+			r.c.Close()
+		}
+	}
+	if winner != nil {
+		return winner, nil
+	}
+	return nil, errs
+}
+
+// An error for each address given to DialMulti, in order.
+type dialMultiError []error
+
+func (me dialMultiError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("all dials failed")
+	for i, err := range me {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+func (me dialMultiError) Unwrap() error {
+	return me[0]
+}
+
+// Whether every dial timed out, so the error can be treated like a single
+// dial's as a net.Error.
+func (me dialMultiError) Timeout() bool {
+	for _, err := range me {
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return false
+		}
+	}
+	return true
+}
+
+func (me dialMultiError) Temporary() bool {
+	return me.Timeout()
+}
@@ -0,0 +1,12 @@
+package utp
+
+import "net"
+
+// Returned by the non-blocking Conn methods when they can't make progress.
+var ErrWouldBlock net.Error = errWouldBlock{}
+
+type errWouldBlock struct{}
+
+func (errWouldBlock) Error() string   { return "operation would block" }
+func (errWouldBlock) Temporary() bool { return true }
+func (errWouldBlock) Timeout() bool   { return false }
@@ -1,7 +1,12 @@
 package utp
 
+/*
+#include "utp.h"
+*/
+import "C"
 import (
 	"expvar"
+	"fmt"
 )
 
 var (
@@ -12,3 +17,75 @@ var (
 	multiMsgRecvs               = expvar.NewInt("utpMultiMsgRecvs")
 	singleMsgRecvs              = expvar.NewInt("utpSingleMsgRecvs")
 )
+
+var (
+	// The Socket currently shown by each expvar registered by PublishExpvar.
+	// expvars can't be unregistered, so names remain in expvarPublished
+	// after their Socket is closed, and show null.
+	expvarSockets   = map[string]*Socket{}
+	expvarPublished = map[string]bool{}
+)
+
+// The value of an expvar registered by Socket.PublishExpvar.
+type socketExpvar struct {
+	BytesRead     int64
+	BytesWritten  int64
+	ConnsOpen     int
+	ConnsAccepted int64
+	ConnsDialed   int64
+	// Packets sent again, as for Conn.Retransmits.
+	Retransmits uint64
+}
+
+// Registers an expvar with the given name, showing totals for the Socket's
+// Conns. Publishing the same name again, from this or another Socket, replaces
+// what it shows. Once the Socket is closed, the expvar shows null. Returns an
+// error if the name is already used by something else.
+func (s *Socket) PublishExpvar(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return errSocketClosed
+	}
+	if !expvarPublished[name] {
+		if expvar.Get(name) != nil {
+			return fmt.Errorf("expvar %q already exists", name)
+		}
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return expvarSnapshot(name)
+		}))
+		expvarPublished[name] = true
+	}
+	expvarSockets[name] = s
+	return nil
+}
+
+// Called with mu held as the Socket is closed.
+func (s *Socket) unpublishExpvars() {
+	for name, s1 := range expvarSockets {
+		if s1 == s {
+			delete(expvarSockets, name)
+		}
+	}
+}
+
+// Takes mu only for the snapshot. The result is marshalled by expvar after
+// we return.
+func expvarSnapshot(name string) interface{} {
+	mu.Lock()
+	defer mu.Unlock()
+	s := expvarSockets[name]
+	if s == nil {
+		return nil
+	}
+	st := s.statsLocked()
+	ret := socketExpvar{
+		BytesRead:     st.BytesRead,
+		BytesWritten:  st.BytesWritten,
+		ConnsOpen:     st.ConnsOpen,
+		ConnsAccepted: st.ConnsAccepted,
+		ConnsDialed:   st.ConnsDialed,
+		Retransmits:   st.Retransmits,
+	}
+	return ret
+}
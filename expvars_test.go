@@ -0,0 +1,51 @@
+package utp
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func expvarValue(t *testing.T, name string) (ret *socketExpvar) {
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &ret))
+	return
+}
+
+func TestSocketPublishExpvar(t *testing.T) {
+	const name = "TestSocketPublishExpvar"
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.PublishExpvar(name))
+	// Idempotent.
+	require.NoError(t, s.PublishExpvar(name))
+	assert.Error(t, s.PublishExpvar("go-libutp"))
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, make([]byte, 5))
+	require.NoError(t, err)
+	v := expvarValue(t, name)
+	require.NotNil(t, v)
+	assert.EqualValues(t, 5, v.BytesRead)
+	assert.EqualValues(t, 5, v.BytesWritten)
+	assert.Equal(t, 2, v.ConnsOpen)
+	assert.EqualValues(t, 1, v.ConnsAccepted)
+	assert.EqualValues(t, 1, v.ConnsDialed)
+	require.NoError(t, s.Close())
+	assert.Nil(t, expvarValue(t, name))
+	assert.Error(t, s.PublishExpvar(name))
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	require.NoError(t, s2.PublishExpvar(name))
+	v = expvarValue(t, name)
+	require.NotNil(t, v)
+	assert.EqualValues(t, 0, v.BytesRead)
+}
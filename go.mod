@@ -1,5 +1,7 @@
 module github.com/anacrolix/go-libutp
 
+go 1.16
+
 require (
 	github.com/anacrolix/envpprof v0.0.0-20180404065416-323002cec2fa
 	github.com/anacrolix/missinggo v0.0.0-20180725070939-60ef2fbf63df
@@ -0,0 +1,42 @@
+package utp
+
+import "github.com/anacrolix/sync"
+
+// The type of the package lock, mu. Socket hooks, such as the OnConnect
+// function, are triggered by libutp callbacks with mu held, so they're queued,
+// and run once it's released. They can then call into the package, including
+// to Close the Conns they're passed.
+type hookMutex struct {
+	sync.Mutex
+	// Hooks to run when the lock is next released.
+	hooks []func()
+	// Whether a goroutine is running hooks. Others leave theirs to it, so
+	// that hooks run one at a time, in the order they were queued.
+	runningHooks bool
+}
+
+// Queues f to run after the lock is released. The lock must be held.
+func (m *hookMutex) queueHook(f func()) {
+	m.hooks = append(m.hooks, f)
+}
+
+// Releases the lock, then runs the queued hooks, unless another goroutine is
+// already running them. That includes a hook releasing the lock itself.
+func (m *hookMutex) Unlock() {
+	if m.runningHooks || len(m.hooks) == 0 {
+		m.Mutex.Unlock()
+		return
+	}
+	m.runningHooks = true
+	for len(m.hooks) != 0 {
+		hooks := m.hooks
+		m.hooks = nil
+		m.Mutex.Unlock()
+		for _, f := range hooks {
+			f()
+		}
+		m.Mutex.Lock()
+	}
+	m.runningHooks = false
+	m.Mutex.Unlock()
+}
@@ -4,11 +4,7 @@ package utp
 #include "utp.h"
 */
 import "C"
-import (
-	"errors"
-
-	"github.com/anacrolix/sync"
-)
+import "fmt"
 
 type Option = C.int
 
@@ -19,12 +15,24 @@ const (
 	SendBuffer  Option = C.UTP_SNDBUF
 	RecvBuffer  Option = C.UTP_RCVBUF
 	TargetDelay Option = C.UTP_TARGET_DELAY
+	// The congestion window new Conns start with, in packets. It's an
+	// addition to libutp, and only applies to Sockets.
+	InitialWindow Option = C.UTP_INITIAL_WINDOW
 
 	TimedOut = C.UTP_ETIMEDOUT
 )
 
 var (
-	mu                 sync.Mutex
+	// Protects all libutp contexts, and the state of every Socket and Conn.
+	// libutp isn't reentrant, and its callbacks modify Conn state, so that
+	// state is guarded by the same lock as the calls into libutp that trigger
+	// them. A per-Conn lock would have to be acquired inside callbacks that
+	// already hold this one, without buying any concurrency. Blocking
+	// operations wait on their Conn's cond, which releases mu, so a parked
+	// Read or Write doesn't hold up other Conns: mu is only held for buffer
+	// copies and calls into libutp. See BenchmarkConcurrentConns. Socket
+	// hooks run after it's released.
+	mu                 hookMutex
 	libContextToSocket = map[*C.utp_context]*Socket{}
 )
 
@@ -32,6 +40,33 @@ func getSocketForLibContext(uc *C.utp_context) *Socket {
 	return libContextToSocket[uc]
 }
 
+// Errors reported by libutp for a Conn. Their messages are libutp's names for
+// the error codes.
+var (
+	ErrConnRefused error = &libError{name: libErrorCodeNames(C.UTP_ECONNREFUSED)}
+	ErrConnReset   error = &libError{name: libErrorCodeNames(C.UTP_ECONNRESET)}
+	ErrTimedOut    error = &libError{name: libErrorCodeNames(C.UTP_ETIMEDOUT), timeout: true}
+)
+
+type libError struct {
+	name    string
+	timeout bool
+}
+
+func (e *libError) Error() string { return e.name }
+
+// Reports whether the error is ErrTimedOut.
+func (e *libError) Timeout() bool { return e.timeout }
+
 func errorForCode(code C.int) error {
-	return errors.New(libErrorCodeNames(code))
+	switch code {
+	case C.UTP_ECONNREFUSED:
+		return ErrConnRefused
+	case C.UTP_ECONNRESET:
+		return ErrConnReset
+	case C.UTP_ETIMEDOUT:
+		return ErrTimedOut
+	default:
+		return fmt.Errorf("unknown libutp error code %d", code)
+	}
 }
@@ -0,0 +1,30 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorForCode(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		err  error
+		name string
+	}{
+		{0, ErrConnRefused, "UTP_ECONNREFUSED"},
+		{1, ErrConnReset, "UTP_ECONNRESET"},
+		{TimedOut, ErrTimedOut, "UTP_ETIMEDOUT"},
+	} {
+		err := errorForCode(Option(tc.code))
+		assert.Equal(t, tc.name, err.Error())
+		assert.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), tc.err))
+	}
+	var te interface{ Timeout() bool }
+	assert.True(t, errors.As(ErrTimedOut, &te) && te.Timeout())
+	assert.False(t, ErrConnReset.(interface{ Timeout() bool }).Timeout())
+	assert.False(t, errors.Is(ErrConnReset, ErrConnRefused))
+	assert.Error(t, errorForCode(99))
+}
@@ -0,0 +1,76 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT isn't supported on this platform")
+
+// Configures the UDP socket created for a Socket, like net.ListenConfig.
+type ListenConfig struct {
+	// Sets SO_REUSEADDR, so the address can be bound again straight after a
+	// previous Socket's been closed. On Windows this also lets other
+	// processes bind the same port.
+	ReuseAddr bool
+	// Sets SO_REUSEPORT, so several Sockets, in this or other processes, can
+	// be bound to the same address. Where the OS supports it, incoming
+	// packets are spread across them by remote address, so a uTP connection
+	// always sees the same Socket. It's an error where it's unsupported,
+	// including Windows.
+	ReusePort bool
+	// Called after the options above are set, and before the socket is
+	// bound, as for net.ListenConfig.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// Like NewSocket, but creating the UDP socket as configured.
+func (lc *ListenConfig) NewSocket(ctx context.Context, network, addr string) (*Socket, error) {
+	var pc net.PacketConn
+	var err error
+	if network == "inproc" {
+		if lc.ReuseAddr || lc.ReusePort || lc.Control != nil {
+			return nil, errors.New("socket options aren't supported for inproc")
+		}
+		pc, err = listenPacket(network, addr)
+	} else {
+		nlc := net.ListenConfig{Control: lc.control}
+		pc, err = nlc.ListenPacket(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket(pc)
+	s.closesPacketConn = true
+	return s, nil
+}
+
+// Like Listen, but creating the UDP socket as configured.
+func (lc *ListenConfig) Listen(ctx context.Context, network, addr string) (*Listener, error) {
+	s, err := lc.NewSocket(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{s}, nil
+}
+
+func (lc *ListenConfig) control(network, address string, c syscall.RawConn) error {
+	if lc.ReuseAddr || lc.ReusePort {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setReuse(fd, lc.ReuseAddr, lc.ReusePort)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", network, address, err)
+		}
+	}
+	if lc.Control != nil {
+		return lc.Control(network, address, c)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenConfigReusePort(t *testing.T) {
+	lc := ListenConfig{ReuseAddr: true, ReusePort: true}
+	s1, err := lc.NewSocket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil && errors.Is(err, errReusePortUnsupported) {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := lc.NewSocket(context.Background(), "udp", s1.Addr().String())
+	require.NoError(t, err)
+	defer s2.Close()
+	assert.Equal(t, s1.Addr().String(), s2.Addr().String())
+	// Without it, the address is taken.
+	_, err = NewSocket("udp", s1.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestListenConfigControl(t *testing.T) {
+	called := false
+	lc := ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		called = true
+		return nil
+	}}
+	l, err := lc.Listen(context.Background(), "udp", "localhost:0")
+	require.NoError(t, err)
+	assert.True(t, called)
+	require.NoError(t, l.Close())
+	_, err = lc.NewSocket(context.Background(), "inproc", "localhost:0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package utp
+
+import (
+	"context"
+	"net"
+)
+
+// A net.Listener that owns its Socket. Conns are accepted once libutp has
+// received their SYN.
+type Listener struct {
+	s *Socket
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func Listen(network, addr string) (*Listener, error) {
+	s, err := NewSocket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{s}, nil
+}
+
+// Blocks until a Conn is accepted, or the Listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.s.Accept()
+}
+
+// As for Socket.AcceptContext. Cancelling ctx stops the wait without closing
+// the Listener.
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	return l.s.AcceptContext(ctx)
+}
+
+// Closes the underlying Socket, which unblocks any pending Accept calls and
+// destroys all Conns accepted by the Listener.
+func (l *Listener) Close() error {
+	return l.s.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.s.Addr()
+}
+
+// The Socket, which can also be used for dialing from the Listener's address.
+func (l *Listener) Socket() *Socket {
+	return l.s
+}
@@ -0,0 +1,61 @@
+package utp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerAccept(t *testing.T) {
+	l, err := Listen("udp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	d, err := DialUDPContext(context.Background(), "udp", nil, l.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	a, err := l.Accept()
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, d.LocalAddr().(*net.UDPAddr).Port, a.RemoteAddr().(*net.UDPAddr).Port)
+}
+
+func TestListenerCloseUnblocksAccept(t *testing.T) {
+	l, err := Listen("udp", "localhost:0")
+	require.NoError(t, err)
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, l.Close())
+	assert.Equal(t, errSocketClosed, <-accepted)
+}
+
+func TestListenerAcceptContext(t *testing.T) {
+	l, err := Listen("udp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = l.AcceptContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// The Listener is still usable.
+	d, err := DialUDPContext(context.Background(), "udp", nil, l.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	type key struct{}
+	ctx = context.WithValue(context.Background(), key{}, "conn value")
+	a, err := l.AcceptContext(ctx)
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, "conn value", a.(*Conn).Context().Value(key{}))
+	assert.Equal(t, context.Background(), d.Context())
+	l.Close()
+	_, err = l.AcceptContext(context.Background())
+	assert.Equal(t, errSocketClosed, err)
+}
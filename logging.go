@@ -11,3 +11,15 @@ const (
 )
 
 var Logger = log.New(os.Stderr, "go-libutp: ", log.LstdFlags|log.Lshortfile)
+
+// Receives libutp's log messages if set. Protected by mu.
+var logHook func(conn *Conn, msg string)
+
+// Routes libutp's log messages to f instead of Logger. conn is the Conn the
+// message concerns, and may be nil. f is called with the package lock held,
+// so it must not call into this package. Passing nil restores the default.
+func SetLogger(f func(conn *Conn, msg string)) {
+	mu.Lock()
+	logHook = f
+	mu.Unlock()
+}
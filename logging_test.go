@@ -1,7 +1,91 @@
 package utp
 
-import "testing"
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestLogger(t *testing.T) {
 	Logger.Printf("hello!")
 }
+
+func TestSetLogger(t *testing.T) {
+	var (
+		msgs  []string
+		conns []*Conn
+	)
+	SetLogger(func(conn *Conn, msg string) {
+		msgs = append(msgs, msg)
+		conns = append(conns, conn)
+	})
+	defer SetLogger(nil)
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetOption(LogNormal, 1)
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, msgs)
+	assert.Contains(t, msgs[0], "UTP_Connect")
+	assert.Equal(t, d, conns[0])
+}
+
+func TestSetLoggerConnLabel(t *testing.T) {
+	var msgs []string
+	SetLogger(func(conn *Conn, msg string) {
+		msgs = append(msgs, msg)
+	})
+	defer SetLogger(nil)
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetOption(LogNormal, 1)
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetLabel("peer 1")
+	assert.Equal(t, "peer 1", c.Label())
+	require.NoError(t, c.Connect(context.Background(), "", s.Addr().String()))
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, msgs)
+	assert.True(t, strings.HasPrefix(msgs[0], "[peer 1] "), msgs[0])
+	assert.Contains(t, msgs[0], "UTP_Connect")
+}
+
+func TestSocketSetDebug(t *testing.T) {
+	var numMsgs int
+	SetLogger(func(*Conn, string) {
+		numMsgs++
+	})
+	defer SetLogger(nil)
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	transfer := func() {
+		d, a := connPairSocket(s)
+		defer d.Close()
+		defer a.Close()
+		go d.Write(make([]byte, 1<<16))
+		_, err := io.CopyN(ioutil.Discard, a, 1<<16)
+		require.NoError(t, err)
+	}
+	transfer()
+	mu.Lock()
+	assert.Equal(t, 0, numMsgs)
+	mu.Unlock()
+	s.SetDebug(true)
+	transfer()
+	mu.Lock()
+	assert.NotEqual(t, 0, numMsgs)
+	mu.Unlock()
+}
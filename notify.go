@@ -0,0 +1,64 @@
+package utp
+
+// A channel of readiness signals for event loops, holding at most one
+// pending, and closed once there will be no more. It's only made once asked
+// for, and is guarded by mu.
+type notifier struct {
+	ch    chan struct{}
+	ended bool
+}
+
+func (n *notifier) get() <-chan struct{} {
+	if n.ch == nil {
+		n.ch = make(chan struct{}, 1)
+		if n.ended {
+			close(n.ch)
+		}
+	}
+	return n.ch
+}
+
+// Leaves a signal pending, unless one already is.
+func (n *notifier) signal() {
+	if n.ch == nil || n.ended {
+		return
+	}
+	select {
+	case n.ch <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) end() {
+	if n.ended {
+		return
+	}
+	n.ended = true
+	if n.ch != nil {
+		close(n.ch)
+	}
+}
+
+// Returns a channel that receives a value when the Conn connects, and each
+// time the send window reopens after a write found it full, so an event loop
+// can select on it instead of blocking in Write. The intended use is to
+// TryWrite until it returns ErrWouldBlock, then wait for the channel. Signals
+// are coalesced, so at most one is pending. It's closed once writes can't
+// succeed, such as after Close, CloseWrite or an error, so the next TryWrite
+// returns why. Every call returns the same channel.
+func (c *Conn) WritableNotify() <-chan struct{} {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.writableNotify.get()
+}
+
+// Like WritableNotify, for reading: the channel receives a value each time
+// data arrives, to TryRead until it returns ErrWouldBlock. It's closed once
+// reads won't block again, such as at the peer's EOF, after CloseRead or
+// Close, or on an error, so the remaining data and then the error can be
+// read.
+func (c *Conn) ReadableNotify() <-chan struct{} {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.readableNotify.get()
+}
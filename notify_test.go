@@ -0,0 +1,93 @@
+package utp
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnWritableNotify(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	dc := d.(*Conn)
+	writable := dc.WritableNotify()
+	assert.Equal(t, writable, dc.WritableNotify())
+	b := make([]byte, 1<<16)
+	for {
+		_, err := dc.TryWrite(b)
+		if err == ErrWouldBlock {
+			break
+		}
+		require.NoError(t, err)
+	}
+	// Drain anything pending from before the window filled.
+	select {
+	case <-writable:
+	default:
+	}
+	go io.Copy(ioutil.Discard, a)
+	select {
+	case _, ok := <-writable:
+		assert.True(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("not notified")
+	}
+	_, err = dc.TryWrite(b)
+	assert.NoError(t, err)
+	require.NoError(t, d.Close())
+	for range writable {
+	}
+	_, err = dc.TryWrite(b)
+	assert.Equal(t, ErrClosed, err)
+	// It's closed already for those asking afterwards.
+	_, ok := <-dc.WritableNotify()
+	assert.False(t, ok)
+}
+
+func TestConnReadableNotify(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer a.Close()
+	ac := a.(*Conn)
+	readable := ac.ReadableNotify()
+	b := make([]byte, 16)
+	_, err = ac.TryRead(b)
+	require.Equal(t, ErrWouldBlock, err)
+	for i := 0; i < 3; i++ {
+		_, err = d.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	var got []byte
+	for len(got) < 15 {
+		select {
+		case _, ok := <-readable:
+			require.True(t, ok)
+		case <-time.After(10 * time.Second):
+			t.Fatal("not notified")
+		}
+		for {
+			n, err := ac.TryRead(b)
+			got = append(got, b[:n]...)
+			if err == ErrWouldBlock {
+				break
+			}
+			require.NoError(t, err)
+		}
+	}
+	assert.EqualValues(t, "hellohellohello", got)
+	require.NoError(t, d.Close())
+	// At EOF it's closed, and reads return it.
+	for range readable {
+	}
+	_, err = ac.TryRead(b)
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,103 @@
+package utp
+
+import (
+	"fmt"
+	"time"
+)
+
+// A token bucket of bytes, refilled continuously at rate bytes per second, and
+// holding up to a tenth of a second's worth.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	rl := &rateLimiter{
+		rate:  float64(bytesPerSec),
+		burst: float64(bytesPerSec) / 10,
+		last:  time.Now(),
+	}
+	if rl.burst < 1 {
+		rl.burst = 1
+	}
+	rl.tokens = rl.burst
+	return rl
+}
+
+// Takes up to max tokens. If none are available, returns how long until one
+// is.
+func (rl *rateLimiter) take(max int, now time.Time) (n int, wait time.Duration) {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	rl.last = now
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	if rl.tokens < 1 {
+		return 0, time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+	}
+	n = max
+	if float64(n) > rl.tokens {
+		n = int(rl.tokens)
+	}
+	rl.tokens -= float64(n)
+	return
+}
+
+// Returns tokens that were taken but not used.
+func (rl *rateLimiter) giveBack(n int) {
+	rl.tokens += float64(n)
+}
+
+func limiterForRate(bytesPerSec int) (*rateLimiter, error) {
+	if bytesPerSec < 0 {
+		return nil, fmt.Errorf("negative rate: %d", bytesPerSec)
+	}
+	if bytesPerSec == 0 {
+		return nil, nil
+	}
+	return newRateLimiter(bytesPerSec), nil
+}
+
+// Limits the rate at which Write, WriteContext and WriteBuffers hand data to
+// libutp to bytesPerSec. They block until the limit allows more, while
+// honouring deadlines. TryWrite isn't limited. This shapes traffic on top of
+// uTP's congestion control, which still applies: the limit only ever makes
+// the Conn slower. Zero removes the limit.
+func (c *Conn) SetWriteLimit(bytesPerSec int) error {
+	rl, err := limiterForRate(bytesPerSec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	c.writeLimiter = rl
+	c.cond.Broadcast()
+	mu.Unlock()
+	return nil
+}
+
+// Limits the rate at which Read and ReadContext return data to bytesPerSec.
+// They block until the limit allows more, while honouring deadlines. Other
+// reading methods aren't limited. Data the limit holds back stays buffered,
+// which closes uTP's receive window, so the peer slows down to match. Zero
+// removes the limit.
+func (c *Conn) SetReadLimit(bytesPerSec int) error {
+	rl, err := limiterForRate(bytesPerSec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	c.readLimiter = rl
+	c.cond.Broadcast()
+	mu.Unlock()
+	return nil
+}
+
+// Waits on cond for at most d.
+func (c *Conn) waitAtMost(d time.Duration) {
+	t := time.AfterFunc(d, c.broadcastLocking)
+	c.cond.Wait()
+	t.Stop()
+}
@@ -0,0 +1,74 @@
+package utp
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	rl := newRateLimiter(1000)
+	now := rl.last
+	n, _ := rl.take(500, now)
+	assert.Equal(t, 100, n)
+	n, wait := rl.take(500, now)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, time.Millisecond, wait)
+	n, _ = rl.take(500, now.Add(10*time.Millisecond))
+	assert.Equal(t, 10, n)
+	rl.giveBack(5)
+	n, _ = rl.take(500, now.Add(10*time.Millisecond))
+	assert.Equal(t, 5, n)
+	// Never more than the burst.
+	n, _ = rl.take(500, now.Add(time.Hour))
+	assert.Equal(t, 100, n)
+}
+
+func TestConnWriteLimit(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc := d.(*Conn)
+	assert.Error(t, dc.SetWriteLimit(-1))
+	require.NoError(t, dc.SetWriteLimit(20000))
+	go io.Copy(ioutil.Discard, a)
+	started := time.Now()
+	n, err := d.Write(make([]byte, 10000))
+	require.NoError(t, err)
+	assert.Equal(t, 10000, n)
+	// A tenth of a second's burst, then 8000 bytes at 20000/s.
+	assert.True(t, time.Since(started) >= 350*time.Millisecond, time.Since(started))
+	// Deadlines still apply while limited.
+	require.NoError(t, d.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	n, err = d.Write(make([]byte, 100000))
+	assert.Equal(t, errDeadlineExceededValue, err)
+	assert.True(t, n < 100000)
+	require.NoError(t, d.SetWriteDeadline(time.Time{}))
+	require.NoError(t, dc.SetWriteLimit(0))
+	started = time.Now()
+	_, err = d.Write(make([]byte, 10000))
+	require.NoError(t, err)
+	assert.True(t, time.Since(started) < 350*time.Millisecond)
+}
+
+func TestConnReadLimit(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	require.NoError(t, a.(*Conn).SetReadLimit(20000))
+	go d.Write(make([]byte, 10000))
+	started := time.Now()
+	_, err = io.ReadFull(a, make([]byte, 10000))
+	require.NoError(t, err)
+	assert.True(t, time.Since(started) >= 350*time.Millisecond, time.Since(started))
+}
@@ -0,0 +1,58 @@
+package utp
+
+// Returns the data buffered by whichever of the Socket's Conns next has some,
+// along with that Conn, so a server can serve many Conns without a goroutine
+// for each. Once a Conn has nothing more to read, it's returned once with a
+// nil slice and its read error, such as io.EOF. Conns closed locally are
+// skipped, and errSocketClosed is returned once the Socket is closed. Conns
+// become eligible when they receive data after the first call. Read limits
+// and read deadlines set on the Conns don't apply.
+func (s *Socket) ReadFromAny() (b []byte, c *Conn, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !s.readAnyEnabled {
+		s.readAnyEnabled = true
+		s.readAnyCond.L = &mu
+		for _, c := range s.conns {
+			s.noteReadable(c)
+		}
+	}
+	for {
+		if s.closed {
+			return nil, nil, errSocketClosed
+		}
+		for len(s.readAnyQueue) != 0 {
+			c = s.readAnyQueue[0]
+			s.readAnyQueue[0] = nil
+			s.readAnyQueue = s.readAnyQueue[1:]
+			c.readAnyQueued = false
+			if c.closed || c.readAnyEnded {
+				continue
+			}
+			if c.readBuf.Len() != 0 {
+				b = make([]byte, c.readBuf.Len())
+				n, _ := c.readNoWait(b)
+				c.addBytesRead(int64(n))
+				return b[:n], c, nil
+			}
+			// The Conns' read deadlines don't apply, and there's nothing else
+			// to report after them.
+			if err = c.readErr(); err != nil && err != errDeadlineExceededValue {
+				c.readAnyEnded = true
+				return nil, c, err
+			}
+		}
+		s.readAnyCond.Wait()
+	}
+}
+
+// Queues c to be looked at by ReadFromAny, once it's in use. Called when c
+// gets data, or might have reached the end of it.
+func (s *Socket) noteReadable(c *Conn) {
+	if !s.readAnyEnabled || c.readAnyQueued {
+		return
+	}
+	c.readAnyQueued = true
+	s.readAnyQueue = append(s.readAnyQueue, c)
+	s.readAnyCond.Broadcast()
+}
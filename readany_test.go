@@ -0,0 +1,58 @@
+package utp
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketReadFromAny(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	d1, a1 := connPairSocket(s)
+	defer a1.Close()
+	d2, a2 := connPairSocket(s)
+	defer a2.Close()
+	_, err = d1.Write([]byte("one"))
+	require.NoError(t, err)
+	// Data received before the first call is still found.
+	b, c, err := s.ReadFromAny()
+	require.NoError(t, err)
+	assert.Equal(t, a1, c)
+	assert.EqualValues(t, "one", b)
+	_, err = d2.Write([]byte("two"))
+	require.NoError(t, err)
+	b, c, err = s.ReadFromAny()
+	require.NoError(t, err)
+	assert.Equal(t, a2, c)
+	assert.EqualValues(t, "two", b)
+	assert.EqualValues(t, 3, c.Stats().BytesRead)
+	// The end of a Conn's data is reported once.
+	require.NoError(t, d2.Close())
+	b, c, err = s.ReadFromAny()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, a2, c)
+	assert.Nil(t, b)
+	_, err = d1.Write([]byte("three"))
+	require.NoError(t, err)
+	b, c, err = s.ReadFromAny()
+	require.NoError(t, err)
+	assert.Equal(t, a1, c)
+	assert.EqualValues(t, "three", b)
+	d1.Close()
+	closed := make(chan error)
+	go func() {
+		for {
+			_, c, err := s.ReadFromAny()
+			if c == nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	require.NoError(t, s.Close())
+	assert.Equal(t, errSocketClosed, <-closed)
+}
@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package utp
+
+import "errors"
+
+func setReuse(fd uintptr, addr, port bool) error {
+	if port {
+		return errReusePortUnsupported
+	}
+	if addr {
+		return errors.New("SO_REUSEADDR isn't supported on this platform")
+	}
+	return nil
+}
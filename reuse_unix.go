@@ -0,0 +1,26 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package utp
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setReuse(fd uintptr, addr, port bool) error {
+	if addr {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return fmt.Errorf("setting SO_REUSEADDR: %w", err)
+		}
+	}
+	if port {
+		if soReusePort == 0 {
+			return errReusePortUnsupported
+		}
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return fmt.Errorf("setting SO_REUSEPORT: %w", err)
+		}
+	}
+	return nil
+}
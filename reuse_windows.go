@@ -0,0 +1,18 @@
+package utp
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setReuse(fd uintptr, addr, port bool) error {
+	if port {
+		return errReusePortUnsupported
+	}
+	if addr {
+		if err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return fmt.Errorf("setting SO_REUSEADDR: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Returns a Socket that sends datagrams by calling send, instead of over a
+// UDP socket, and is fed those it receives by ReceivePacket, so uTP can run
+// over another transport, such as DTLS or an overlay network. Peers are
+// identified by *net.UDPAddr, which a transport without IP addresses must map
+// its own to. localAddr is returned by the Socket's Addr.
+//
+// send is called with the package lock held, so it must not call into this
+// package, and shouldn't block. Neither b nor addr may be retained after it
+// returns. Errors from send are handled as for UDP write errors.
+func NewSocketWithSendTo(send func(b []byte, addr net.Addr) error, localAddr net.Addr) (*Socket, error) {
+	if send == nil {
+		return nil, errors.New("nil send func")
+	}
+	if localAddr == nil {
+		return nil, errors.New("nil local address")
+	}
+	s := newSocket(&sendToPacketConn{
+		send:        send,
+		localAddr:   localAddr,
+		closed:      make(chan struct{}),
+		interrupted: make(chan struct{}),
+	})
+	s.SetClosesPacketConn(true)
+	return s, nil
+}
+
+// Processes a datagram received from addr, as though it had been read from
+// the Socket's PacketConn. This is how packets arrive for Sockets from
+// NewSocketWithSendTo. b isn't retained.
+func (s *Socket) ReceivePacket(b []byte, addr net.Addr) error {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return fmt.Errorf("unsupported address type %T", addr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return errSocketClosed
+	}
+	if s.processReceivedMessage(b, addr) && !s.closed {
+		s.afterReceivingUtpMessages()
+	}
+	return nil
+}
+
+// The PacketConn for a Socket from NewSocketWithSendTo. Reads block until
+// it's closed, or a read deadline passes, as packets are given to the Socket
+// by ReceivePacket instead.
+type sendToPacketConn struct {
+	send      func([]byte, net.Addr) error
+	localAddr net.Addr
+	closeOnce sync.Once
+	closed    chan struct{}
+	// Closed by a read deadline in the past, which is how a Socket that
+	// doesn't close its PacketConn stops reading.
+	interruptOnce sync.Once
+	interrupted   chan struct{}
+}
+
+var errSendToPacketConnClosed = errors.New("closed")
+
+func (pc *sendToPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	select {
+	case <-pc.closed:
+		return 0, nil, errSendToPacketConnClosed
+	case <-pc.interrupted:
+		return 0, nil, errDeadlineExceededValue
+	}
+}
+
+func (pc *sendToPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.closed:
+		return 0, errSendToPacketConnClosed
+	default:
+	}
+	if err := pc.send(b, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *sendToPacketConn) Close() error {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+	return nil
+}
+
+func (pc *sendToPacketConn) LocalAddr() net.Addr { return pc.localAddr }
+
+func (pc *sendToPacketConn) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+// Only deadlines that have already passed are supported, and they can't be
+// undone.
+func (pc *sendToPacketConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() || t.After(time.Now()) {
+		return errors.New("only past read deadlines are supported")
+	}
+	pc.interruptOnce.Do(func() { close(pc.interrupted) })
+	return nil
+}
+
+func (pc *sendToPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
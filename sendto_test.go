@@ -0,0 +1,70 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/anacrolix/missinggo/inproc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Connects two Sockets from NewSocketWithSendTo, delivering each datagram from
+// its own goroutine, as send mustn't call into the package.
+func sendToSocketPair(t *testing.T) (s1, s2 *Socket) {
+	addrs := [2]*net.UDPAddr{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 1},
+	}
+	var ss [2]*Socket
+	for i := range ss {
+		from := addrs[i]
+		peer := &ss[1-i]
+		s, err := NewSocketWithSendTo(func(b []byte, addr net.Addr) error {
+			b = append([]byte(nil), b...)
+			go (*peer).ReceivePacket(b, from)
+			return nil
+		}, from)
+		require.NoError(t, err)
+		ss[i] = s
+	}
+	return ss[0], ss[1]
+}
+
+func TestNewSocketWithSendTo(t *testing.T) {
+	_, err := NewSocketWithSendTo(nil, &net.UDPAddr{})
+	assert.Error(t, err)
+	s1, s2 := sendToSocketPair(t)
+	defer s1.Close()
+	defer s2.Close()
+	assert.Equal(t, "10.0.0.2:1", s2.Addr().String())
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		a, err := s2.Accept()
+		require.NoError(t, err)
+		accepted <- a
+	}()
+	d, err := s1.Dial(s2.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	a := <-accepted
+	defer a.Close()
+	assert.Equal(t, s1.Addr().String(), a.RemoteAddr().String())
+	data := bytes.Repeat([]byte("hello"), 10000)
+	go d.Write(data)
+	b := make([]byte, len(data))
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+	// Datagrams that aren't uTP are passed to ReadFrom, as for UDP.
+	require.NoError(t, s1.ReceivePacket([]byte("stun"), s2.Addr()))
+	n, from, err := s1.ReadFrom(b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "stun", b[:n])
+	assert.Equal(t, s2.Addr(), from)
+	assert.Error(t, s1.ReceivePacket([]byte("stun"), inproc.Addr{Port: 1}))
+	require.NoError(t, s1.Close())
+	assert.Equal(t, errSocketClosed, s1.ReceivePacket([]byte("stun"), s2.Addr()))
+}
@@ -7,6 +7,7 @@ import "C"
 import (
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -37,15 +38,48 @@ func toSockaddrInet(ip net.IP, port int, zone string) (rsa syscall.RawSockaddrAn
 	return
 }
 
+// Caches interface indexes by name, so that packets from named zones don't
+// need an interface lookup each.
+var zoneIndexes sync.Map
+
 func zoneToScopeId(zone string) uint32 {
 	if zone == "" {
 		return 0
 	}
-	if ifi, err := net.InterfaceByName(zone); err == nil {
-		return uint32(ifi.Index)
+	if ui64, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(ui64)
+	}
+	if id, ok := zoneIndexes.Load(zone); ok {
+		return id.(uint32)
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0
+	}
+	zoneIndexes.Store(zone, uint32(ifi.Index))
+	return uint32(ifi.Index)
+}
+
+// Returns the zone as an interface index. This is cheap enough for the
+// per-packet path, and accepted anywhere a zone is.
+func scopeIdToNumericZone(id uint32) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(id))
+}
+
+// Returns the zone as an interface name where the interface exists. This
+// looks up the interface, so it's only for addresses that are kept, like
+// Conn.RemoteAddr.
+func scopeIdToZone(id uint32) string {
+	if id == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(id)); err == nil {
+		return ifi.Name
 	}
-	ui64, _ := strconv.ParseUint(zone, 10, 32)
-	return uint32(ui64)
+	return scopeIdToNumericZone(id)
 }
 
 func structSockaddrToUDPAddr(sa *C.struct_sockaddr, udp *net.UDPAddr) error {
@@ -63,6 +97,7 @@ func anySockaddrToUdp(rsa *syscall.RawSockaddrAny, udp *net.UDPAddr) error {
 		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
 		udp.Port = int(sa.Port)
 		udp.IP = append(udp.IP[:0], sa.Addr[:]...)
+		udp.Zone = scopeIdToNumericZone(sa.Scope_id)
 		return nil
 	default:
 		return syscall.EAFNOSUPPORT
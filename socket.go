@@ -30,10 +30,13 @@ void process_received_messages(utp_context *ctx, struct utp_process_udp_args *ar
 */
 import "C"
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"net"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -49,6 +52,15 @@ const (
 	issueDeferredUtpAcksDelay = 1000 * time.Microsecond
 )
 
+// A uTP endpoint on a PacketConn, on which Conns are both accepted and
+// dialed. As they share its port, a Socket can be used for UDP hole punching:
+// both peers Dial each other's public address at about the same time, so each
+// one's outgoing packets open its NAT to the other's. The Socket must be
+// accepting for the peer's connection to get through. uTP has no simultaneous
+// open like TCP's, so if both peers' SYNs arrive, each ends up with two Conns:
+// the one it dialed, and the peer's, from Accept. They're independent, and
+// the peers have to agree which to keep, such as the one dialed by the peer
+// with the lower address, and close the other.
 type Socket struct {
 	pc               net.PacketConn
 	ctx              *C.utp_context
@@ -59,8 +71,48 @@ type Socket struct {
 	writeDeadline    time.Time
 	readDeadline     time.Time
 	firewallCallback FirewallCallback
+	// Set by SetPacketInterceptor.
+	packetInterceptor PacketInterceptor
+	// ReadFromAny has been called, and Conns that may be readable are queued
+	// for it. readAnyCond.L is mu.
+	readAnyEnabled bool
+	readAnyQueue   []*Conn
+	readAnyCond    sync.Cond
 	// Whether the next accept is to be blocked.
 	block bool
+	// Set by Shutdown. New connections are refused.
+	shuttingDown bool
+	// Set by SetMaxConns. Zero is unlimited.
+	maxConns int
+	// Set by SetAcceptFilter.
+	acceptFilter func(remote net.Addr) bool
+	// Set by SetIdleTimeout. Zero never closes idle Conns.
+	idleTimeout time.Duration
+	// Set by SetDefaultReadDeadline and SetDefaultWriteDeadline. Zero leaves
+	// new Conns without deadlines.
+	defaultReadDeadline  time.Duration
+	defaultWriteDeadline time.Duration
+	// Whether pc is closed with the Socket.
+	closesPacketConn bool
+	// Closed when packetReader returns.
+	packetReaderDone chan struct{}
+	// The maximum UDP payload size for new connections. Zero uses libutp's
+	// default.
+	mtu int
+
+	// Conns that are connected or accepted, and not yet destroyed.
+	numConns      int
+	connsAccepted int64
+	connsDialed   int64
+	// Totals for the Socket's Conns, for PublishExpvar.
+	bytesRead       int64
+	bytesWritten    int64
+	destroyedRexmit uint64
+
+	onMtuChanged         func(conn *Conn, oldMtu, newMtu int)
+	onOverheadStatistics func(conn *Conn, direction, bytes, overheadType int)
+	onConnect            func(*Conn)
+	onClose              func(*Conn, error)
 
 	acksScheduled bool
 	ackTimer      *time.Timer
@@ -70,10 +122,14 @@ type Socket struct {
 
 type FirewallCallback func(net.Addr) bool
 
+// Returns whether a UDP datagram to or from addr should be dropped.
+type PacketInterceptor func(pkt []byte, addr net.Addr, outgoing bool) (drop bool)
+
 var (
-	_               net.PacketConn = (*Socket)(nil)
-	_               net.Listener   = (*Socket)(nil)
-	errSocketClosed                = errors.New("Socket closed")
+	_                     net.PacketConn = (*Socket)(nil)
+	_                     net.Listener   = (*Socket)(nil)
+	errSocketClosed                      = errors.New("Socket closed")
+	errSocketShuttingDown                = errors.New("Socket shutting down")
 )
 
 type packet struct {
@@ -93,18 +149,39 @@ func NewSocket(network, addr string) (*Socket, error) {
 	if err != nil {
 		return nil, err
 	}
+	s := newSocket(pc)
+	s.closesPacketConn = true
+	return s, nil
+}
+
+// Returns a Socket that runs uTP over an existing PacketConn, such as one
+// shared with STUN. Packets that aren't uTP are returned by the Socket's
+// ReadFrom. The caller keeps ownership of pc unless SetClosesPacketConn is
+// used: by default closing the Socket won't close pc. Instead Close uses pc's
+// read deadline to interrupt the Socket's reads, waits for them to stop, and
+// then clears the deadline; any earlier read deadline on pc is lost.
+func NewSocketFromPacketConn(pc net.PacketConn) (*Socket, error) {
+	if pc == nil {
+		return nil, errors.New("nil PacketConn")
+	}
+	return newSocket(pc), nil
+}
+
+func newSocket(pc net.PacketConn) *Socket {
 	s := &Socket{
 		pc:          pc,
 		backlog:     make(chan *Conn, 5),
 		conns:       make(map[*C.utp_socket]*Conn),
 		nonUtpReads: make(chan packet, 100),
+
+		packetReaderDone: make(chan struct{}),
 	}
 	s.ackTimer = time.AfterFunc(math.MaxInt64, s.ackTimerFunc)
 	s.ackTimer.Stop()
 	func() {
 		mu.Lock()
 		defer mu.Unlock()
-		ctx := C.utp_init(2)
+		ctx := C.utp_init(C.UTP_API_VERSION)
 		if ctx == nil {
 			panic(ctx)
 		}
@@ -119,7 +196,16 @@ func NewSocket(network, addr string) (*Socket, error) {
 		s.utpTimeoutChecker = time.AfterFunc(0, s.timeoutCheckerTimerFunc)
 	}()
 	go s.packetReader()
-	return s, nil
+	return s
+}
+
+// Sets whether closing the Socket also closes its PacketConn. This is true
+// for Sockets from NewSocket and NewSocketWithSendTo, and false for
+// NewSocketFromPacketConn.
+func (s *Socket) SetClosesPacketConn(closes bool) {
+	mu.Lock()
+	s.closesPacketConn = closes
+	mu.Unlock()
 }
 
 func (s *Socket) onLibSocketDestroyed(ls *C.utp_socket) {
@@ -128,20 +214,33 @@ func (s *Socket) onLibSocketDestroyed(ls *C.utp_socket) {
 
 func (s *Socket) newConn(us *C.utp_socket) *Conn {
 	c := &Conn{
-		s:         s,
-		us:        us,
-		localAddr: s.pc.LocalAddr(),
+		s:            s,
+		us:           us,
+		localAddr:    s.pc.LocalAddr(),
+		closedCh:     make(chan struct{}),
+		lastActivity: time.Now(),
+		readBuf:      new(bytes.Buffer),
+		lentBuf:      new(bytes.Buffer),
 	}
 	c.cond.L = &mu
 	s.conns[us] = c
-	c.writeDeadlineTimer = time.AfterFunc(-1, c.cond.Broadcast)
-	c.readDeadlineTimer = time.AfterFunc(-1, c.cond.Broadcast)
+	c.writeDeadlineTimer = time.AfterFunc(-1, c.broadcastLocking)
+	c.readDeadlineTimer = time.AfterFunc(-1, c.broadcastLocking)
+	if s.defaultReadDeadline != 0 {
+		c.readDeadline = c.lastActivity.Add(s.defaultReadDeadline)
+		c.resetReadDeadlineTimer()
+	}
+	if s.defaultWriteDeadline != 0 {
+		c.writeDeadline = c.lastActivity.Add(s.defaultWriteDeadline)
+		c.writeDeadlineTimer.Reset(s.defaultWriteDeadline)
+	}
 	return c
 }
 
 const maxNumBuffers = 16
 
 func (s *Socket) packetReader() {
+	defer close(s.packetReaderDone)
 	mc := mmsg.NewConn(s.pc)
 	// Increasing the messages increases the memory use, but also means we can
 	// reduces utp_issue_deferred_acks and syscalls which should improve
@@ -190,7 +289,10 @@ func (s *Socket) packetReader() {
 			consecutiveErrors++
 			if consecutiveErrors >= 100 {
 				Logger.Print("too many consecutive errors, closing socket")
-				s.Close()
+				// Close would wait for us to return.
+				mu.Lock()
+				s.closeLocked()
+				mu.Unlock()
 				return
 			}
 			continue
@@ -210,15 +312,20 @@ func (s *Socket) processReceivedMessages(ms []mmsg.Message) {
 	}
 	if processPacketsInC {
 		var args [maxNumBuffers]C.struct_utp_process_udp_args
-		for i, m := range ms {
+		i := 0
+		for _, m := range ms {
+			if s.intercept(m.Buffers[0][:m.N], m.Addr, false) {
+				continue
+			}
 			a := &args[i]
+			i++
 			a.buf = (*C.byte)(&m.Buffers[0][0])
 			a.len = C.size_t(m.N)
 			var rsa syscall.RawSockaddrAny
 			rsa, a.sal = netAddrToLibSockaddr(m.Addr)
 			a.sa = (*C.struct_sockaddr)(unsafe.Pointer(&rsa))
 		}
-		C.process_received_messages(s.ctx, &args[0], C.size_t(len(ms)))
+		C.process_received_messages(s.ctx, &args[0], C.size_t(i))
 	} else {
 		gotUtp := false
 		for _, m := range ms {
@@ -259,6 +366,9 @@ func (s *Socket) ackTimerFunc() {
 }
 
 func (s *Socket) processReceivedMessage(b []byte, addr net.Addr) (utp bool) {
+	if s.intercept(b, addr, false) {
+		return false
+	}
 	if s.utpProcessUdp(b, addr) {
 		socketUtpPacketsReceived.Add(1)
 		return true
@@ -315,6 +425,8 @@ func (s *Socket) timeoutCheckerTimerFunc() {
 	ok := s.ctx != nil
 	if ok {
 		s.checkUtpTimeouts()
+		s.checkMtus()
+		s.closeIdleConns()
 	}
 	if ok {
 		s.utpTimeoutChecker.Reset(utpCheckTimeoutInterval)
@@ -323,9 +435,199 @@ func (s *Socket) timeoutCheckerTimerFunc() {
 }
 
 func (s *Socket) Close() error {
+	mu.Lock()
+	alreadyClosed := s.closed
+	err := s.closeLocked()
+	closesPacketConn := s.closesPacketConn
+	mu.Unlock()
+	if alreadyClosed || closesPacketConn || err != nil {
+		return err
+	}
+	// Hand pc back only once we've stopped reading from it, and without the
+	// deadline used to interrupt us.
+	<-s.packetReaderDone
+	if err := s.pc.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("clearing PacketConn read deadline: %w", err)
+	}
+	return nil
+}
+
+// Limits the number of live Conns, as counted by NumConns. Once there are n,
+// incoming connections are refused with a reset, so dialers fail promptly with
+// ErrConnRefused instead of timing out. They're never returned by Accept. Zero
+// removes the limit. Existing Conns aren't affected.
+func (s *Socket) SetMaxConns(n int) error {
+	if n < 0 {
+		return fmt.Errorf("negative max conns: %d", n)
+	}
+	mu.Lock()
+	s.maxConns = n
+	mu.Unlock()
+	return nil
+}
+
+// Sets a function to be consulted for each incoming connection, before a Conn
+// is created for it. If f returns false, the peer is sent a reset, so the
+// dialer fails promptly with ErrConnRefused, and nothing is queued for
+// Accept. Unlike SetFirewallCallback, it's only called for connection
+// attempts. f is called with the package lock held, so it must be fast, must
+// not block, and must not call into this package. Passing nil removes it.
+func (s *Socket) SetAcceptFilter(f func(remote net.Addr) bool) {
+	mu.Lock()
+	s.acceptFilter = f
+	mu.Unlock()
+}
+
+// Has Conns created afterwards, as they're dialed or as peers' connections
+// arrive, start with their read deadline d after that, as though
+// SetReadDeadline had been called. Their own SetReadDeadline overrides it.
+// Zero, the default, sets none.
+func (s *Socket) SetDefaultReadDeadline(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative default read deadline: %v", d)
+	}
+	mu.Lock()
+	s.defaultReadDeadline = d
+	mu.Unlock()
+	return nil
+}
+
+// Like SetDefaultReadDeadline, for write deadlines.
+func (s *Socket) SetDefaultWriteDeadline(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative default write deadline: %v", d)
+	}
+	mu.Lock()
+	s.defaultWriteDeadline = d
+	mu.Unlock()
+	return nil
+}
+
+// Closes connected Conns once nothing has been read from or written to them
+// for d, so the peer is told, and any blocked Read or Write returns ErrClosed.
+// Conns are checked every half second or so, so they may be idle for a little
+// longer than d. Zero, the default, never closes them.
+func (s *Socket) SetIdleTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative idle timeout: %v", d)
+	}
+	mu.Lock()
+	s.idleTimeout = d
+	mu.Unlock()
+	return nil
+}
+
+func (s *Socket) closeIdleConns() {
+	if s.idleTimeout == 0 || s.closed {
+		return
+	}
+	now := time.Now()
+	for _, c := range s.conns {
+		if !c.gotConnect || c.closed || c.destroyed {
+			continue
+		}
+		if now.Sub(c.lastActivity) >= s.idleTimeout {
+			c.close()
+		}
+	}
+}
+
+func (s *Socket) addLiveConn(c *Conn) {
+	c.counted = true
+	s.numConns++
+	if onConnect := s.onConnect; onConnect != nil {
+		mu.queueHook(func() { onConnect(c) })
+	}
+}
+
+// Sets a function to be called as each Conn is connected or accepted: the
+// Conns counted by NumConns. Accepted Conns are passed to it before Accept
+// returns them. Like the other hooks, f is called once the package lock is
+// released, on the goroutine that released it. Hooks run one at a time, in
+// order, so f must not block for long, or wait on another hook. Passing nil
+// removes it.
+func (s *Socket) OnConnect(f func(*Conn)) {
+	mu.Lock()
+	s.onConnect = f
+	mu.Unlock()
+}
+
+// Sets a function to be called once libutp destroys a Conn that was passed to
+// the OnConnect function, or would have been. err is why the Conn ended: the
+// error from libutp, such as ErrConnReset, if there was one, then ErrClosed
+// if it was closed locally, io.EOF if the peer closed it, and ErrDestroyed
+// otherwise, such as when the Socket is closed. f is called as for OnConnect.
+// Passing nil removes it.
+func (s *Socket) OnClose(f func(c *Conn, err error)) {
+	mu.Lock()
+	s.onClose = f
+	mu.Unlock()
+}
+
+// Returns the number of Conns that have been connected or accepted, and not
+// yet destroyed.
+func (s *Socket) NumConns() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.numConns
+}
+
+// Returns the total number of connections accepted by the Socket. This
+// includes those dropped because the accept backlog was full.
+func (s *Socket) ConnsAccepted() int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.connsAccepted
+}
+
+// Returns the total number of connections dialed from the Socket that
+// completed their handshake.
+func (s *Socket) ConnsDialed() int64 {
 	mu.Lock()
 	defer mu.Unlock()
-	return s.closeLocked()
+	return s.connsDialed
+}
+
+// How often Shutdown checks whether the Conns have drained.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Closes the Socket gracefully. New connections are refused, while existing
+// ones get to have everything written to them acknowledged by their peers.
+// Then the Socket is closed. If ctx is done first, the Socket is closed anyway,
+// and ctx's error is returned.
+func (s *Socket) Shutdown(ctx context.Context) error {
+	mu.Lock()
+	s.shuttingDown = true
+	for _, c := range s.conns {
+		c.cond.Broadcast()
+	}
+	mu.Unlock()
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for !s.drained() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return s.Close()
+}
+
+// Whether all the Conns have no unacknowledged data.
+func (s *Socket) drained() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return true
+	}
+	for us, c := range s.conns {
+		if c.inited && !c.destroyed && C.utp_get_bytes_in_flight(us) != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Socket) closeLocked() error {
@@ -335,14 +637,30 @@ func (s *Socket) closeLocked() error {
 	// Calling this deletes the pointer. It must not be referred to after
 	// this.
 	C.utp_destroy(s.ctx)
+	// Callbacks from utp_destroy still need to find the Socket.
+	delete(libContextToSocket, s.ctx)
 	s.ctx = nil
-	s.pc.Close()
+	var err error
+	if s.closesPacketConn {
+		s.pc.Close()
+	} else {
+		// Unblock packetReader, which sees we're closed, and stops.
+		err = s.pc.SetReadDeadline(time.Now())
+	}
 	close(s.backlog)
 	close(s.nonUtpReads)
 	s.closed = true
+	s.readAnyQueue = nil
+	if s.readAnyEnabled {
+		s.readAnyCond.Broadcast()
+	}
 	s.ackTimer.Stop()
 	s.utpTimeoutChecker.Stop()
 	s.acksScheduled = false
+	s.unpublishExpvars()
+	if err != nil {
+		return fmt.Errorf("interrupting PacketConn reads: %w", err)
+	}
 	return nil
 }
 
@@ -354,14 +672,40 @@ func (s *Socket) LocalAddr() net.Addr {
 	return s.pc.LocalAddr()
 }
 
+// Returns the PacketConn the Socket runs over, for diagnostics and setting
+// socket options. It must not be read from, as that takes packets from the
+// Socket, or written to other than through Socket.WriteTo, as packets to a
+// Conn's peer would corrupt its uTP stream. Closing it breaks the Socket.
+func (s *Socket) PacketConn() net.PacketConn {
+	return s.pc
+}
+
 func (s *Socket) Accept() (net.Conn, error) {
 	nc, ok := <-s.backlog
 	if !ok {
-		return nil, errors.New("closed")
+		return nil, errSocketClosed
 	}
 	return nc, nil
 }
 
+// Like Accept, but returns ctx.Err() if ctx is done before a Conn is
+// accepted, leaving the Socket open. The Conn's Context method returns ctx,
+// so per-Conn values can be attached to it with context.WithValue first.
+func (s *Socket) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case c, ok := <-s.backlog:
+		if !ok {
+			return nil, errSocketClosed
+		}
+		mu.Lock()
+		c.ctx = ctx
+		mu.Unlock()
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (s *Socket) Dial(addr string) (net.Conn, error) {
 	return s.DialTimeout(addr, 0)
 }
@@ -376,11 +720,57 @@ func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, erro
 	return s.DialContext(ctx, "", addr)
 }
 
-func (s *Socket) resolveAddr(network, addr string) (net.Addr, error) {
-	if network == "" {
-		network = s.Addr().Network()
+// Resolves addr to the addresses the Socket can dial, in the resolver's
+// order. A hostname can resolve to several, of which those of a family the
+// network or the Socket's local address excludes are dropped.
+func (s *Socket) resolveAddrs(ctx context.Context, network, addr string) ([]net.Addr, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		ua, err := resolveAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Addr{ua}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
 	}
-	return resolveAddr(network, addr)
+	if host == "" {
+		// It's the local system, which ResolveUDPAddr handles.
+		ua, err := resolveAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Addr{ua}, nil
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, network, port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var localIP net.IP
+	if la, ok := s.Addr().(*net.UDPAddr); ok {
+		localIP = la.IP
+	}
+	var ret []net.Addr
+	for _, ip := range ips {
+		switch {
+		case network == "udp4" && ip.IP.To4() == nil:
+		case network == "udp6" && ip.IP.To4() != nil:
+		case !addrFamiliesMatch(localIP, ip.IP):
+		default:
+			ret = append(ret, &net.UDPAddr{IP: ip.IP, Port: portNum, Zone: ip.Zone})
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no %s addresses for %q", network, host)
+	}
+	return ret, nil
 }
 
 func resolveAddr(network, addr string) (net.Addr, error) {
@@ -392,13 +782,56 @@ func resolveAddr(network, addr string) (net.Addr, error) {
 	}
 }
 
-// Passing an empty network will use the network of the Socket's listener.
+// Resolves addr, which may have a hostname, and dials each address it
+// resolves to in turn until one connects, like net.Dialer. If ctx has a
+// deadline, each address is given an even share of the time remaining, but
+// no less than dialMinAttempt, so an unresponsive address doesn't use it
+// all. If none connect, the first address's error is returned. Passing an
+// empty network will use the network of the Socket's listener.
 func (s *Socket) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "" {
+		network = s.Addr().Network()
+	}
+	uas, err := s.resolveAddrs(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving address: %v", err)
+	}
+	var firstErr error
+	for i, ua := range uas {
+		c, err := s.dialAttempt(ctx, ua, len(uas)-i)
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// The least time DialContext gives each address when there's a deadline,
+// unless less than that remains.
+const dialMinAttempt = 2 * time.Second
+
+// Dials ua, with a share of ctx's remaining time if it's one of several.
+func (s *Socket) dialAttempt(ctx context.Context, ua net.Addr, remaining int) (*Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok && remaining > 1 {
+		timeout := time.Until(deadline) / time.Duration(remaining)
+		if timeout < dialMinAttempt {
+			timeout = dialMinAttempt
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	c, err := s.NewConn()
 	if err != nil {
 		return nil, err
 	}
-	err = c.Connect(ctx, network, addr)
+	err = c.connect(ctx, ua)
 	if err != nil {
 		c.Close()
 		return nil, err
@@ -412,6 +845,9 @@ func (s *Socket) NewConn() (*Conn, error) {
 	if s.closed {
 		return nil, errors.New("socket closed")
 	}
+	if s.shuttingDown {
+		return nil, errSocketShuttingDown
+	}
 	return s.newConn(C.utp_create_socket(s.ctx)), nil
 }
 
@@ -460,6 +896,12 @@ func (s *Socket) SetDeadline(t time.Time) error {
 }
 
 func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	mu.Lock()
+	drop := s.intercept(b, addr, true)
+	mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
 	return s.pc.WriteTo(b, addr)
 }
 
@@ -490,6 +932,157 @@ func (s *Socket) SetOption(opt Option, val int) int {
 	return int(C.utp_context_set_option(s.ctx, opt, C.int(val)))
 }
 
+// libutp won't search for an MTU below this.
+const minMtu = 576
+
+// Caps the UDP payload size libutp will use, for networks with a known small
+// MTU, such as tunnels. libutp searches for the path MTU between 576 and this
+// value. It applies to connections created after the call, and to existing
+// ones when they next restart their MTU search. Zero restores the default.
+func (s *Socket) SetMTU(bytes int) error {
+	if bytes != 0 && (bytes < minMtu || bytes > math.MaxUint16) {
+		return fmt.Errorf("MTU out of range: %d", bytes)
+	}
+	mu.Lock()
+	s.mtu = bytes
+	mu.Unlock()
+	return nil
+}
+
+// Returns the value set by SetMTU. If it's zero, libutp's default is used,
+// which is 1402 bytes for IPv4, and 1232 for IPv6.
+func (s *Socket) MTU() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.mtu
+}
+
+// Sets a function to be called when the packet size libutp uses for a Conn
+// changes, as it discovers the path MTU. Changes are looked for periodically,
+// so they're reported up to half a second late. The first call for each Conn
+// has an oldMtu of 0. f is called as for OnConnect.
+func (s *Socket) OnMTUChanged(f func(conn *Conn, oldMtu, newMtu int)) {
+	mu.Lock()
+	s.onMtuChanged = f
+	mu.Unlock()
+}
+
+// Sets a function to be called with the bytes libutp spends on protocol
+// overhead rather than payload, as each packet is sent or received. direction
+// is OverheadSent or OverheadReceived, and overheadType is one of the
+// Overhead*Type constants. For packets carrying payload, only the uTP header
+// is counted. bytes includes the IP and UDP headers otherwise. conn is nil if
+// the packet can't be attributed to a known Conn. f is called with the
+// package lock held, so it must not call into this package. Passing nil stops
+// the accounting.
+func (s *Socket) OnOverheadStatistics(f func(conn *Conn, direction, bytes, overheadType int)) {
+	mu.Lock()
+	defer mu.Unlock()
+	s.onOverheadStatistics = f
+	if !s.closed {
+		setOverheadStatisticsCallback(s.ctx, f != nil)
+	}
+}
+
+// libutp doesn't notify us of MTU changes, so we look for them on the timeout
+// tick. Checking after every received batch would cost a cgo call per Conn per
+// packet.
+func (s *Socket) checkMtus() {
+	if s.onMtuChanged == nil || s.closed {
+		return
+	}
+	for us, c := range s.conns {
+		if !c.inited || c.destroyed {
+			continue
+		}
+		mtu := int(C.utp_get_mtu(us))
+		if mtu == c.mtu {
+			continue
+		}
+		old := c.mtu
+		c.mtu = mtu
+		c, onMtuChanged := c, s.onMtuChanged
+		mu.queueHook(func() { onMtuChanged(c, old, mtu) })
+	}
+}
+
+// Toggles libutp's MTU and debug logging, which are delivered through
+// SetLogger. It can be changed at any time. The debug messages are mostly
+// compiled out unless libutp is built with UTP_DEBUG_LOGGING, and are very
+// verbose and expensive when they aren't.
+func (s *Socket) SetDebug(enabled bool) {
+	val := 0
+	if enabled {
+		val = 1
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.ctx.setOption(LogMtu, val)
+	s.ctx.setOption(LogDebug, val)
+}
+
+// Sets the congestion window, in packets, that Conns start with before slow
+// start grows it; the equivalent of TCP's initcwnd. libutp starts with 1.
+// Larger values speed up short transfers on links with a high
+// bandwidth-delay product, at the cost of fairness: the first round trip's
+// burst ignores whatever else is using the path, and can cause loss if the
+// path can't absorb it. libutp limits the window to 255 packets regardless.
+// It applies to Conns created after the call.
+func (s *Socket) SetInitialWindow(packets int) error {
+	if packets < 1 || packets > 255 {
+		return fmt.Errorf("initial window out of range: %d packets", packets)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return errSocketClosed
+	}
+	if i := s.ctx.setOption(InitialWindow, packets); i != 0 {
+		return fmt.Errorf("utp_context_set_option returned %d", i)
+	}
+	return nil
+}
+
+// Sets the one-way queuing delay libutp's congestion control aims for. Higher
+// values compete harder with other traffic, lower values yield to it sooner.
+// The default is 100ms. It applies to Conns created after the call. libutp
+// tracks it in microseconds, so d must be at least 1µs and fit in an int32 of
+// them.
+func (s *Socket) SetCongestionTarget(d time.Duration) error {
+	us := d / time.Microsecond
+	if us < 1 || us > math.MaxInt32 {
+		return fmt.Errorf("congestion target out of range: %v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed {
+		return errSocketClosed
+	}
+	if i := s.ctx.setOption(TargetDelay, int(us)); i != 0 {
+		return fmt.Errorf("utp_context_set_option returned %d", i)
+	}
+	return nil
+}
+
+// Sets a function to be consulted for every datagram the Socket receives,
+// before libutp or ReadFrom see it, and for every datagram it sends,
+// including those from WriteTo. Datagrams for which f returns true are
+// silently discarded, such as to simulate loss in tests. f is called with the
+// package lock held, so it must not call into this package, and it must not
+// retain pkt or addr. Passing nil removes it.
+func (s *Socket) SetPacketInterceptor(f PacketInterceptor) {
+	mu.Lock()
+	s.packetInterceptor = f
+	mu.Unlock()
+}
+
+func (s *Socket) intercept(b []byte, addr net.Addr, outgoing bool) (drop bool) {
+	return s.packetInterceptor != nil && s.packetInterceptor(b, addr, outgoing)
+}
+
 func (s *Socket) SetFirewallCallback(f FirewallCallback) {
 	mu.Lock()
 	s.firewallCallback = f
@@ -1,10 +1,19 @@
 package utp
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func TestUseClosedSocket(t *testing.T) {
@@ -23,3 +32,705 @@ func TestSocketNetwork(t *testing.T) {
 	defer s.Close()
 	assert.Equal(t, "udp", s.Addr().Network())
 }
+
+func TestSocketDialHostname(t *testing.T) {
+	s1, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	go s2.Accept()
+	_, port, err := net.SplitHostPort(s2.Addr().String())
+	require.NoError(t, err)
+	c, err := s1.Dial(net.JoinHostPort("localhost", port))
+	require.NoError(t, err)
+	assert.Equal(t, s2.Addr().String(), c.RemoteAddr().String())
+	c.Close()
+	// An IPv4 Socket can't dial IPv6 addresses.
+	_, err = s1.DialContext(context.Background(), "udp6", net.JoinHostPort("localhost", port))
+	assert.Error(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s1.DialContext(ctx, "", net.JoinHostPort("localhost", port))
+	assert.Error(t, err)
+}
+
+func TestSocketSetDSCP(t *testing.T) {
+	s, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetDSCP(64))
+	assert.Error(t, s.SetDSCP(-1))
+	require.NoError(t, s.SetDSCP(46))
+	tos, err := ipv4.NewPacketConn(s.pc).TOS()
+	require.NoError(t, err)
+	assert.Equal(t, 46<<2, tos)
+}
+
+func TestSocketSetTrafficClass(t *testing.T) {
+	s, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetTrafficClass(256))
+	assert.Error(t, s.SetTrafficClass(-1))
+	require.NoError(t, s.SetTrafficClass(0xb9))
+	tos, err := ipv4.NewPacketConn(s.pc).TOS()
+	require.NoError(t, err)
+	assert.Equal(t, 0xb9, tos)
+}
+
+func TestSocketSetTTL(t *testing.T) {
+	s, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetTTL(0))
+	assert.Error(t, s.SetTTL(256))
+	require.NoError(t, s.SetTTL(1))
+	ttl, err := ipv4.NewPacketConn(s.pc).TTL()
+	require.NoError(t, err)
+	assert.Equal(t, 1, ttl)
+	s, err = NewSocket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("error creating IPv6 socket: %s", err)
+	}
+	defer s.Close()
+	require.NoError(t, s.SetTTL(2))
+	hops, err := ipv6.NewPacketConn(s.pc).HopLimit()
+	require.NoError(t, err)
+	assert.Equal(t, 2, hops)
+}
+
+func TestSocketSetUDPBuffers(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.SetUDPReadBuffer(1<<20))
+	require.NoError(t, s.SetUDPWriteBuffer(1<<20))
+	s, err = NewSocket("inproc", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetUDPReadBuffer(1<<20))
+	assert.Error(t, s.SetUDPWriteBuffer(1<<20))
+}
+
+func TestSocketSyscallConn(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	rc, err := s.SyscallConn()
+	require.NoError(t, err)
+	called := false
+	require.NoError(t, rc.Control(func(uintptr) { called = true }))
+	assert.True(t, called)
+	s, err = NewSocket("inproc", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.SyscallConn()
+	assert.Error(t, err)
+}
+
+func TestSocketSetMTU(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetMTU(575))
+	assert.Error(t, s.SetMTU(1<<16))
+	assert.Equal(t, 0, s.MTU())
+	require.NoError(t, s.SetMTU(1000))
+	assert.Equal(t, 1000, s.MTU())
+	var msgs []string
+	SetLogger(func(_ *Conn, msg string) {
+		msgs = append(msgs, msg)
+	})
+	defer SetLogger(nil)
+	s.SetDebug(true)
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, msgs)
+	assert.Contains(t, msgs[0], "MTU [RESET] floor:576 ceiling:1000")
+}
+
+func TestSocketOnMTUChanged(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.SetMTU(1000))
+	var (
+		hookMu  sync.Mutex
+		newMtus []int
+		conns   = map[*Conn]bool{}
+	)
+	s.OnMTUChanged(func(c *Conn, oldMtu, newMtu int) {
+		assert.NotEqual(t, oldMtu, newMtu)
+		hookMu.Lock()
+		newMtus = append(newMtus, newMtu)
+		conns[c] = true
+		hookMu.Unlock()
+	})
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	go d.Write(make([]byte, 1<<16))
+	_, err = io.CopyN(ioutil.Discard, a, 1<<16)
+	require.NoError(t, err)
+	// Wait for a timeout tick to pick up the changes.
+	time.Sleep(2 * utpCheckTimeoutInterval)
+	hookMu.Lock()
+	defer hookMu.Unlock()
+	require.NotEmpty(t, newMtus)
+	for _, mtu := range newMtus {
+		assert.True(t, mtu <= 1000)
+	}
+	assert.True(t, conns[d.(*Conn)])
+}
+
+func TestSocketSetCongestionTarget(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	assert.Error(t, s.SetCongestionTarget(0))
+	assert.Error(t, s.SetCongestionTarget(time.Nanosecond))
+	assert.Error(t, s.SetCongestionTarget((math.MaxInt32+1)*time.Microsecond))
+	assert.NoError(t, s.SetCongestionTarget(25*time.Millisecond))
+	d, a := connPairSocket(s)
+	d.Close()
+	a.Close()
+	require.NoError(t, s.Close())
+	assert.Equal(t, errSocketClosed, s.SetCongestionTarget(time.Second))
+}
+
+func TestSocketSetInitialWindow(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetInitialWindow(0))
+	assert.Error(t, s.SetInitialWindow(256))
+	var windows []int
+	for _, packets := range []int{1, 10} {
+		require.NoError(t, s.SetInitialWindow(packets))
+		d, a := connPairSocket(s)
+		windows = append(windows, d.(*Conn).SendWindow())
+		d.Close()
+		a.Close()
+	}
+	assert.True(t, windows[1] >= 5*windows[0], windows)
+	require.NoError(t, s.Close())
+	assert.Equal(t, errSocketClosed, s.SetInitialWindow(1))
+}
+
+func TestSocketOnOverheadStatistics(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	var sent, received int
+	types := make(map[int]bool)
+	s.OnOverheadStatistics(func(conn *Conn, direction, bytes, overheadType int) {
+		assert.True(t, bytes > 0)
+		types[overheadType] = true
+		switch direction {
+		case OverheadSent:
+			sent += bytes
+		case OverheadReceived:
+			received += bytes
+		default:
+			t.Errorf("unexpected direction %d", direction)
+		}
+	})
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, make([]byte, 5))
+	require.NoError(t, err)
+	mu.Lock()
+	assert.NotZero(t, sent)
+	assert.NotZero(t, received)
+	assert.True(t, types[OverheadConnectType])
+	mu.Unlock()
+	s.OnOverheadStatistics(nil)
+	mu.Lock()
+	sent = 0
+	mu.Unlock()
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, make([]byte, 5))
+	require.NoError(t, err)
+	mu.Lock()
+	assert.Zero(t, sent)
+	mu.Unlock()
+}
+
+func TestNewSocketFromPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	s, err := NewSocketFromPacketConn(pc)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, pc.LocalAddr(), s.Addr())
+	d, a := connPairSocket(s)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(a, make([]byte, 5))
+	require.NoError(t, err)
+	d.Close()
+	a.Close()
+	require.NoError(t, s.Close())
+	// The PacketConn is handed back, with no read deadline, and nothing else
+	// reading from it.
+	_, err = pc.WriteTo([]byte("stun"), pc.LocalAddr())
+	require.NoError(t, err)
+	b := make([]byte, 0x10000)
+	for {
+		// Skip any uTP packets left over from the closing Conns.
+		n, _, err := pc.ReadFrom(b)
+		require.NoError(t, err)
+		if string(b[:n]) == "stun" {
+			break
+		}
+	}
+}
+
+func TestSocketPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	s, err := NewSocketFromPacketConn(pc)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, pc, s.PacketConn())
+	s, err = NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, s.Addr(), s.PacketConn().LocalAddr())
+}
+
+func TestSocketSetPacketInterceptor(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	var in, out, data, dropped int
+	s.SetPacketInterceptor(func(b []byte, addr net.Addr, outgoing bool) bool {
+		if !outgoing {
+			in++
+			return false
+		}
+		out++
+		if b[0] != 0x01 {
+			return false
+		}
+		// Drop some of the first outgoing data packets.
+		data++
+		if data%2 == 0 && dropped < 3 {
+			dropped++
+			return true
+		}
+		return false
+	})
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	const n = 100 << 10
+	go func() {
+		d.Write(make([]byte, n))
+	}()
+	_, err = io.CopyN(ioutil.Discard, a, n)
+	require.NoError(t, err)
+	mu.Lock()
+	assert.NotZero(t, in)
+	assert.True(t, out >= in)
+	assert.Equal(t, 3, dropped)
+	mu.Unlock()
+	assert.NotZero(t, d.(*Conn).Retransmits())
+	// Incoming datagrams that aren't uTP are dropped before ReadFrom.
+	s.SetPacketInterceptor(func(b []byte, addr net.Addr, outgoing bool) bool {
+		return !outgoing && string(b) == "drop"
+	})
+	_, err = s.WriteTo([]byte("drop"), s.Addr())
+	require.NoError(t, err)
+	_, err = s.WriteTo([]byte("keep"), s.Addr())
+	require.NoError(t, err)
+	b := make([]byte, 10)
+	n1, _, err := s.ReadFrom(b)
+	require.NoError(t, err)
+	assert.EqualValues(t, "keep", b[:n1])
+}
+
+func TestNewSocketFromPacketConnClosesPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	s, err := NewSocketFromPacketConn(pc)
+	require.NoError(t, err)
+	s.SetClosesPacketConn(true)
+	require.NoError(t, s.Close())
+	_, err = pc.WriteTo([]byte("stun"), pc.LocalAddr())
+	assert.Error(t, err)
+}
+
+func TestSocketShutdown(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		a, err := s2.Accept()
+		require.NoError(t, err)
+		accepted <- a
+	}()
+	d, err := s1.Dial(s2.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	a := <-accepted
+	defer a.Close()
+	const n = 1 << 20
+	read := make(chan int64, 1)
+	go func() {
+		m, _ := io.Copy(ioutil.Discard, a)
+		read <- m
+	}()
+	_, err = d.Write(make([]byte, n))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s1.Shutdown(ctx))
+	_, err = s1.NewConn()
+	assert.Error(t, err)
+	a.Close()
+	assert.EqualValues(t, n, <-read)
+}
+
+func TestSocketShutdownContextDone(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	go s2.Accept()
+	d, err := s1.Dial(s2.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	go d.Write(make([]byte, 1<<20))
+	for d.(*Conn).BytesInFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The peer goes away, so what's in flight is never acknowledged.
+	require.NoError(t, s2.Close())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s1.Shutdown(ctx))
+	_, err = s1.NewConn()
+	assert.Error(t, err)
+}
+
+func TestSocketConnCounts(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, 0, s.NumConns())
+	d, a := connPairSocket(s)
+	assert.Equal(t, 2, s.NumConns())
+	assert.EqualValues(t, 1, s.ConnsAccepted())
+	assert.EqualValues(t, 1, s.ConnsDialed())
+	d.Close()
+	a.Close()
+	for s.NumConns() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, 1, s.ConnsAccepted())
+	assert.EqualValues(t, 1, s.ConnsDialed())
+}
+
+func TestSocketStats(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	d, a := connPairSocket(s)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(a, b)
+	require.NoError(t, err)
+	st := s.Stats()
+	assert.Equal(t, 2, st.ConnsOpen)
+	assert.EqualValues(t, 1, st.ConnsAccepted)
+	assert.EqualValues(t, 1, st.ConnsDialed)
+	assert.EqualValues(t, 5, st.BytesRead)
+	assert.EqualValues(t, 5, st.BytesWritten)
+	assert.True(t, st.MeanRTT >= 0)
+	assert.False(t, st.Closed)
+	require.NoError(t, s.Close())
+	st = s.Stats()
+	assert.True(t, st.Closed)
+	assert.Equal(t, 0, st.ConnsOpen)
+	assert.EqualValues(t, 5, st.BytesRead)
+	assert.Zero(t, st.MeanRTT)
+}
+
+func TestSocketSetMaxConns(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	assert.Error(t, s1.SetMaxConns(-1))
+	require.NoError(t, s1.SetMaxConns(1))
+	go s1.Accept()
+	c, err := s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	started := time.Now()
+	_, err = s2.DialTimeout(s1.Addr().String(), 10*time.Second)
+	assert.Equal(t, ErrConnRefused, err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+	assert.Equal(t, 1, s1.NumConns())
+	require.NoError(t, s1.SetMaxConns(0))
+	go s1.Accept()
+	c, err = s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	c.Close()
+}
+
+func TestSocketSetAcceptFilter(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	var filtered []net.Addr
+	s1.SetAcceptFilter(func(remote net.Addr) bool {
+		filtered = append(filtered, remote)
+		return false
+	})
+	started := time.Now()
+	_, err = s2.DialTimeout(s1.Addr().String(), 10*time.Second)
+	assert.Equal(t, ErrConnRefused, err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+	assert.Zero(t, s1.NumConns())
+	mu.Lock()
+	require.Len(t, filtered, 1)
+	assert.Equal(t, s2.Addr().String(), filtered[0].String())
+	mu.Unlock()
+	s1.SetAcceptFilter(nil)
+	go s1.Accept()
+	c, err := s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	c.Close()
+}
+
+func TestSocketDefaultDeadlines(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Error(t, s.SetDefaultReadDeadline(-1))
+	require.NoError(t, s.SetDefaultReadDeadline(50*time.Millisecond))
+	require.NoError(t, s.SetDefaultWriteDeadline(100*time.Millisecond))
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	started := time.Now()
+	_, err = a.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.True(t, time.Since(started) < time.Second)
+	// Nothing reads, so the write has to wait for the buffers to drain.
+	_, err = d.Write(make([]byte, 8<<20))
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	// The Conn's own deadline overrides the default.
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+	go d.(*Conn).Reset()
+	_, err = io.Copy(ioutil.Discard, a)
+	assert.Equal(t, ErrConnReset, err)
+	require.NoError(t, s.SetDefaultReadDeadline(0))
+	require.NoError(t, s.SetDefaultWriteDeadline(0))
+	d, a = connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	mu.Lock()
+	assert.True(t, a.(*Conn).readDeadline.IsZero())
+	assert.True(t, d.(*Conn).writeDeadline.IsZero())
+	mu.Unlock()
+}
+
+func TestSocketSetIdleTimeout(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	assert.Error(t, s1.SetIdleTimeout(-1))
+	const idleTimeout = 300 * time.Millisecond
+	require.NoError(t, s1.SetIdleTimeout(idleTimeout))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		a, err := s1.Accept()
+		require.NoError(t, err)
+		accepted <- a
+	}()
+	d, err := s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	a := <-accepted
+	defer a.Close()
+	// Activity keeps the Conn open beyond the idle timeout.
+	for i := 0; i < 10; i++ {
+		_, err = d.Write([]byte("x"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(a, make([]byte, 1))
+		require.NoError(t, err)
+		time.Sleep(idleTimeout / 3)
+	}
+	// Then it's closed, and the peer is told.
+	started := time.Now()
+	_, err = a.Read(make([]byte, 1))
+	assert.Equal(t, ErrClosed, err)
+	assert.True(t, time.Since(started) >= idleTimeout/2)
+	_, err = d.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSocketOnConnectOnClose(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	type closeEvent struct {
+		c   *Conn
+		err error
+	}
+	// The events are compared by identity, as comparing Conns deeply reads
+	// state that's in use. Hooks run after the lock is released, so they may
+	// not have run yet when the calls that triggered them return.
+	connected := make(chan *Conn, 2)
+	closed := make(chan closeEvent, 2)
+	for _, s := range []*Socket{s1, s2} {
+		s.OnConnect(func(c *Conn) {
+			connected <- c
+		})
+		s.OnClose(func(c *Conn, err error) {
+			closed <- closeEvent{c, err}
+		})
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		a, err := s1.Accept()
+		require.NoError(t, err)
+		accepted <- a
+	}()
+	d, err := s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	a := <-accepted
+	conns := map[*Conn]bool{<-connected: true, <-connected: true}
+	assert.True(t, conns[d.(*Conn)])
+	assert.True(t, conns[a.(*Conn)])
+	assert.Empty(t, closed)
+	// The dialer is closed locally, and the acceptor sees it closed by the
+	// peer.
+	require.NoError(t, d.(*Conn).CloseWithTimeout(5*time.Second))
+	_, err = a.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, s1.Close())
+	ev := <-closed
+	assert.True(t, ev.c == d.(*Conn))
+	assert.Equal(t, ErrClosed, ev.err)
+	ev = <-closed
+	assert.True(t, ev.c == a.(*Conn))
+	assert.Equal(t, io.EOF, ev.err)
+	assert.Empty(t, connected)
+}
+
+// Hooks can close the Conns they're passed.
+func TestSocketCloseFromHooks(t *testing.T) {
+	s1, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s2.Close()
+	hookCloses := make(chan error, 2)
+	// Reject every accepted Conn, as though it failed some check.
+	s1.OnConnect(func(c *Conn) {
+		hookCloses <- c.Close()
+	})
+	// Closing an ended Conn again is harmless.
+	s2.OnClose(func(c *Conn, err error) {
+		hookCloses <- c.Close()
+	})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		a, err := s1.Accept()
+		require.NoError(t, err)
+		accepted <- a
+	}()
+	d, err := s2.Dial(s1.Addr().String())
+	require.NoError(t, err)
+	a := <-accepted
+	// The OnConnect hook ran before Accept returned.
+	assert.NoError(t, <-hookCloses)
+	_, err = a.Read(make([]byte, 1))
+	assert.Equal(t, ErrClosed, err)
+	require.NoError(t, d.(*Conn).CloseSync())
+	assert.NoError(t, <-hookCloses)
+	require.NoError(t, d.Close())
+}
+
+// Peers hole punching dial each other at once from the Sockets they accept on.
+// Each gets both the Conn it dialed, and the one dialed by its peer.
+func TestSocketSimultaneousDial(t *testing.T) {
+	var ss [2]*Socket
+	for i := range ss {
+		s, err := NewSocket("udp", "localhost:0")
+		require.NoError(t, err)
+		defer s.Close()
+		ss[i] = s
+	}
+	var (
+		dialed, accepted [2]net.Conn
+		wg               sync.WaitGroup
+	)
+	for i := range ss {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c, err := ss[i].Accept()
+			require.NoError(t, err)
+			accepted[i] = c
+		}()
+		go func() {
+			defer wg.Done()
+			c, err := ss[i].Dial(ss[1-i].Addr().String())
+			require.NoError(t, err)
+			dialed[i] = c
+		}()
+	}
+	wg.Wait()
+	for i := range ss {
+		defer dialed[i].Close()
+		defer accepted[i].Close()
+		assert.Equal(t, dialed[i].LocalAddr().String(), accepted[1-i].RemoteAddr().String())
+		// Only the dialer can write first.
+		_, err := dialed[i].Write([]byte{byte(i)})
+		require.NoError(t, err)
+		b := make([]byte, 1)
+		_, err = io.ReadFull(accepted[1-i], b)
+		require.NoError(t, err)
+		assert.EqualValues(t, i, b[0])
+	}
+}
@@ -0,0 +1,108 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var _ syscall.Conn = (*Socket)(nil)
+
+// Returns the raw connection of the Socket's PacketConn, if it has one. All the
+// Socket's Conns are multiplexed over it, so any changes made through it
+// affect all of them.
+func (s *Socket) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := s.pc.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("PacketConn doesn't implement syscall.Conn")
+	}
+	return sc.SyscallConn()
+}
+
+// Sets the DSCP (differentiated services code point) of outgoing packets. This
+// applies to all Conns on the Socket.
+func (s *Socket) SetDSCP(value int) error {
+	if value < 0 || value > 63 {
+		return fmt.Errorf("DSCP value out of range: %d", value)
+	}
+	// DSCP is the upper 6 bits of the TOS/traffic class byte.
+	return s.setTOS(value << 2)
+}
+
+func (s *Socket) setTOS(tos int) error {
+	if isIPv4PacketConn(s.pc) {
+		if err := ipv4.NewPacketConn(s.pc).SetTOS(tos); err != nil {
+			return fmt.Errorf("setting IP_TOS: %w", err)
+		}
+		return nil
+	}
+	if err := ipv6.NewPacketConn(s.pc).SetTrafficClass(tos); err != nil {
+		return fmt.Errorf("setting IPV6_TCLASS: %w", err)
+	}
+	// A dual-stack socket also sends IPv4 packets. Not all platforms support
+	// this, and there's nothing more we can do if they don't.
+	ipv4.NewPacketConn(s.pc).SetTOS(tos)
+	return nil
+}
+
+// Sets the whole traffic class (IPv6) or TOS (IPv4) byte of outgoing
+// packets, including the ECN bits that SetDSCP leaves clear. This applies to
+// all Conns on the Socket.
+func (s *Socket) SetTrafficClass(tc int) error {
+	if tc < 0 || tc > 255 {
+		return fmt.Errorf("traffic class out of range: %d", tc)
+	}
+	return s.setTOS(tc)
+}
+
+// Sets the TTL (IPv4) or unicast hop limit (IPv6) of outgoing packets, such
+// as 1 to keep them on the local link. This applies to all Conns on the
+// Socket.
+func (s *Socket) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return fmt.Errorf("TTL out of range: %d", ttl)
+	}
+	if isIPv4PacketConn(s.pc) {
+		if err := ipv4.NewPacketConn(s.pc).SetTTL(ttl); err != nil {
+			return fmt.Errorf("setting IP_TTL: %w", err)
+		}
+		return nil
+	}
+	if err := ipv6.NewPacketConn(s.pc).SetHopLimit(ttl); err != nil {
+		return fmt.Errorf("setting IPV6_UNICAST_HOPS: %w", err)
+	}
+	// As for setTOS.
+	ipv4.NewPacketConn(s.pc).SetTTL(ttl)
+	return nil
+}
+
+// Sets the kernel's receive buffer size (SO_RCVBUF) for the Socket's UDP
+// socket. Datagrams arriving faster than they're read are dropped once it's
+// full. This is separate from the uTP buffers set by SetReadBuffer. The
+// kernel may clamp or adjust the size.
+func (s *Socket) SetUDPReadBuffer(bytes int) error {
+	uc, ok := s.pc.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("PacketConn is %T, not *net.UDPConn", s.pc)
+	}
+	return uc.SetReadBuffer(bytes)
+}
+
+// Sets the kernel's send buffer size (SO_SNDBUF) for the Socket's UDP
+// socket, as for SetUDPReadBuffer.
+func (s *Socket) SetUDPWriteBuffer(bytes int) error {
+	uc, ok := s.pc.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("PacketConn is %T, not *net.UDPConn", s.pc)
+	}
+	return uc.SetWriteBuffer(bytes)
+}
+
+func isIPv4PacketConn(pc net.PacketConn) bool {
+	ua, ok := pc.LocalAddr().(*net.UDPAddr)
+	return ok && ua.IP.To4() != nil
+}
@@ -0,0 +1,8 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build aix darwin dragonfly freebsd netbsd openbsd
+
+package utp
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
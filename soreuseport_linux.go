@@ -0,0 +1,8 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package utp
+
+// The syscall package only defines SO_REUSEPORT for some Linux
+// architectures.
+const soReusePort = 0xf
@@ -0,0 +1,6 @@
+//go:build mips || mipsle || mips64 || mips64le
+// +build mips mipsle mips64 mips64le
+
+package utp
+
+const soReusePort = 0x200
@@ -0,0 +1,4 @@
+package utp
+
+// Zero for unsupported.
+const soReusePort = 0
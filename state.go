@@ -0,0 +1,68 @@
+package utp
+
+import "fmt"
+
+// A Conn's lifecycle state, returned by Conn.State.
+type ConnState int
+
+const (
+	// Connect hasn't completed. This includes Conns from Socket.NewConn that
+	// Connect hasn't been called on.
+	Connecting ConnState = iota
+	// The handshake completed, or the Conn was accepted. This doesn't
+	// guarantee the next Write succeeds: the peer may have gone away without
+	// us knowing yet.
+	Connected
+	// Close was called.
+	Closed
+	// libutp destroyed the underlying socket, such as once the Socket was
+	// closed.
+	Destroyed
+	// The Conn failed, such as with an error from libutp. The error is
+	// returned by Conn.Err.
+	Errored
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	case Closed:
+		return "Closed"
+	case Destroyed:
+		return "Destroyed"
+	case Errored:
+		return "Errored"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+// Returns the Conn's current state. Close takes precedence over an error, and
+// an error over the socket being destroyed.
+func (c *Conn) State() ConnState {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case c.closed:
+		return Closed
+	case c.err != nil:
+		return Errored
+	case c.destroyed:
+		return Destroyed
+	case c.gotConnect:
+		return Connected
+	default:
+		return Connecting
+	}
+}
+
+// Returns the error the Conn failed with, such as one reported by libutp, or
+// nil.
+func (c *Conn) Err() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,35 @@
+package utp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnState(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := s.NewConn()
+	require.NoError(t, err)
+	assert.Equal(t, Connecting, c.State())
+	c.Close()
+	assert.Equal(t, Closed, c.State())
+	d, a := connPairSocket(s)
+	defer d.Close()
+	defer a.Close()
+	dc, ac := d.(*Conn), a.(*Conn)
+	assert.Equal(t, Connected, dc.State())
+	assert.Equal(t, Connected, ac.State())
+	assert.NoError(t, dc.Err())
+	mu.Lock()
+	s.onLibError(dc.us, ErrConnReset)
+	mu.Unlock()
+	assert.Equal(t, Errored, dc.State())
+	assert.Equal(t, ErrConnReset, dc.Err())
+	require.NoError(t, s.Close())
+	assert.Equal(t, Destroyed, ac.State())
+	assert.Equal(t, "Destroyed", ac.State().String())
+	assert.Equal(t, "ConnState(-1)", ConnState(-1).String())
+}
@@ -0,0 +1,247 @@
+package utp
+
+/*
+#include "utp.h"
+*/
+import "C"
+import (
+	"math"
+	"time"
+)
+
+// A snapshot of a Conn's counters, returned by Conn.Stats.
+type ConnStats struct {
+	// Bytes returned to, and accepted from the user.
+	BytesRead    int64
+	BytesWritten int64
+
+	// These are from libutp's utp_socket_stats, which our copy maintains
+	// without _DEBUG. They're zero once the underlying socket has been
+	// destroyed.
+	BytesRecv  uint64 // Total bytes received.
+	BytesXmit  uint64 // Total bytes transmitted.
+	Rexmit     uint32 // Retransmit counter.
+	FastRexmit uint32 // Fast retransmit counter.
+	Xmit       uint32 // Transmit counter.
+	Recv       uint32 // Receive counter (total).
+}
+
+func (c *Conn) Stats() (ret ConnStats) {
+	mu.Lock()
+	defer mu.Unlock()
+	ret.BytesRead = c.numBytesRead
+	ret.BytesWritten = c.numBytesWritten
+	if c.us == nil {
+		return
+	}
+	ls := C.utp_get_stats(c.us)
+	if ls == nil {
+		return
+	}
+	ret.BytesRecv = uint64(ls.nbytes_recv)
+	ret.BytesXmit = uint64(ls.nbytes_xmit)
+	ret.Rexmit = uint32(ls.rexmit)
+	ret.FastRexmit = uint32(ls.fastrexmit)
+	ret.Xmit = uint32(ls.nxmit)
+	ret.Recv = uint32(ls.nrecv)
+	return
+}
+
+// The state of a Conn's LEDBAT congestion control, returned by
+// Conn.DelayInfo. The delays are one-way estimates from the microsecond
+// timestamps in packets, updated as each packet with one arrives.
+type DelayInfo struct {
+	// The lowest delay sample from the last few minutes. It includes the
+	// offset between the peers' clocks, so only changes in it mean anything.
+	BaseDelay time.Duration
+	// The queuing delay on the path from the peer, above BaseDelay, which
+	// congestion control compares to its target. Zero until it's sampled.
+	CurrentDelay time.Duration
+	// The same for the path to the peer, from the delays it reports.
+	PeerDelay time.Duration
+	// The congestion target less CurrentDelay, as of the last ack. The
+	// window grows in proportion when it's positive, and shrinks when it's
+	// negative.
+	OffTarget time.Duration
+	// The time since CurrentDelay was last sampled.
+	Age time.Duration
+}
+
+// Returns the Conn's congestion control state, such as to see whether
+// queuing delay is what's limiting throughput. It's all zero once the Conn
+// is destroyed.
+func (c *Conn) DelayInfo() (ret DelayInfo) {
+	mu.Lock()
+	defer mu.Unlock()
+	// libutp asserts the socket has been connected.
+	if c.us == nil || !c.inited {
+		return
+	}
+	var ours, theirs, age, base C.uint32
+	var offTarget C.int32
+	if C.utp_get_delays(c.us, &ours, &theirs, &age) != 0 {
+		return
+	}
+	C.utp_get_ccontrol_state(c.us, &base, &offTarget)
+	// The histories are filled with the maximum until they're sampled.
+	sampled := func(d C.uint32) time.Duration {
+		if d == math.MaxUint32 {
+			return 0
+		}
+		return time.Duration(d) * time.Microsecond
+	}
+	ret.BaseDelay = time.Duration(base) * time.Microsecond
+	ret.CurrentDelay = sampled(ours)
+	ret.PeerDelay = sampled(theirs)
+	ret.OffTarget = time.Duration(offTarget) * time.Microsecond
+	ret.Age = time.Duration(age) * time.Millisecond
+	return
+}
+
+// Counts of the acks a Conn has sent, returned by Conn.AckStats, to tell
+// whether acks are holding up request and response latency. libutp doesn't
+// delay acks on a timer: those due for received data are scheduled, and sent
+// once the Socket has handled the batch of datagrams it read, unless a data
+// packet carries them first. So LastAckDelay is normally microseconds, and a
+// long one suggests the Socket's reading is held up. The sending side's
+// holding back of small packets is separate, and disabled by SetNoDelay.
+type AckStats struct {
+	// Acks sent on their own, not carried by data, including keepalives.
+	AcksSent uint64
+	// Of AcksSent, those that were scheduled rather than sent immediately.
+	DeferredAcks uint64
+	// Scheduled acks that were carried by a data packet instead.
+	PiggybackedAcks uint64
+	// How long the last scheduled ack waited, to microsecond resolution.
+	LastAckDelay time.Duration
+}
+
+// Returns the Conn's AckStats. It's all zero once the Conn is destroyed.
+func (c *Conn) AckStats() (ret AckStats) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return
+	}
+	var sent, deferred, piggybacked C.uint64
+	var delay C.uint32
+	C.utp_get_ack_stats(c.us, &sent, &deferred, &piggybacked, &delay)
+	ret.AcksSent = uint64(sent)
+	ret.DeferredAcks = uint64(deferred)
+	ret.PiggybackedAcks = uint64(piggybacked)
+	ret.LastAckDelay = time.Duration(delay) * time.Microsecond
+	return
+}
+
+// The options in effect for a Conn, as libutp has them, returned by
+// Conn.Options.
+type ConnOptions struct {
+	// As set by Conn.SetWriteBuffer and SetReadBuffer, or inherited from
+	// the Socket's options when the Conn was created.
+	SendBuffer int
+	RecvBuffer int
+	// The queuing delay congestion control aims for, from
+	// Socket.SetCongestionTarget.
+	CongestionTarget time.Duration
+	// The packet size in use, which follows path MTU discovery.
+	PacketSize int
+}
+
+// Returns the Conn's effective options, to check what a setting took effect
+// as. They're all zero once the Conn is destroyed.
+func (c *Conn) Options() (ret ConnOptions) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return
+	}
+	ret.SendBuffer = int(C.utp_getsockopt(c.us, C.UTP_SNDBUF))
+	ret.RecvBuffer = int(C.utp_getsockopt(c.us, C.UTP_RCVBUF))
+	ret.CongestionTarget = time.Duration(C.utp_getsockopt(c.us, C.UTP_TARGET_DELAY)) * time.Microsecond
+	ret.PacketSize = int(C.utp_get_mtu(c.us))
+	return
+}
+
+// Returns the number of packets the Conn has sent again: after timeouts, when
+// the peer reported them lost, and fast retransmits. ConnStats.Rexmit and
+// FastRexmit count only the latter two. Unlike them, it's kept once the Conn
+// is destroyed, and is cheap enough to poll.
+func (c *Conn) Retransmits() int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.us == nil {
+		return c.retransmits
+	}
+	return int64(C.utp_get_retransmits(c.us))
+}
+
+// A snapshot of the totals for a Socket's Conns, returned by Socket.Stats.
+type SocketStats struct {
+	// Conns counted by NumConns, and the totals of those accepted and
+	// dialed.
+	ConnsOpen     int
+	ConnsAccepted int64
+	ConnsDialed   int64
+	// Bytes returned to, and accepted from, users of the Conns.
+	BytesRead    int64
+	BytesWritten int64
+	// Packets sent again, as for Conn.Retransmits.
+	Retransmits uint64
+	// The mean of libutp's round trip time estimates for the open Conns, or
+	// zero if there are none.
+	MeanRTT time.Duration
+	// The Socket has been closed. The totals are as they were then.
+	Closed bool
+}
+
+// Returns the totals for the Socket's Conns, including those already
+// destroyed. It's safe to call once the Socket's closed.
+func (s *Socket) Stats() SocketStats {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.statsLocked()
+}
+
+func (s *Socket) statsLocked() SocketStats {
+	ret := SocketStats{
+		ConnsOpen:     s.numConns,
+		ConnsAccepted: s.connsAccepted,
+		ConnsDialed:   s.connsDialed,
+		BytesRead:     s.bytesRead,
+		BytesWritten:  s.bytesWritten,
+		Retransmits:   s.destroyedRexmit,
+		Closed:        s.closed,
+	}
+	var rttSum time.Duration
+	numRtts := 0
+	for us, c := range s.conns {
+		if !c.inited || c.destroyed {
+			continue
+		}
+		ret.Retransmits += uint64(C.utp_get_retransmits(us))
+		if c.counted {
+			rttSum += time.Duration(C.utp_get_rtt(us)) * time.Millisecond
+			numRtts++
+		}
+	}
+	if numRtts != 0 {
+		ret.MeanRTT = rttSum / time.Duration(numRtts)
+	}
+	return ret
+}
+
+// Directions passed to the Socket.OnOverheadStatistics callback.
+const (
+	OverheadReceived = 0
+	OverheadSent     = 1
+)
+
+// Overhead types passed to the Socket.OnOverheadStatistics callback. These
+// mirror libutp's bandwidth_type_t, which isn't in its public header.
+const (
+	OverheadConnectType    = 1 // SYN and its reply.
+	OverheadCloseType      = 2 // RESET packets received.
+	OverheadAckType        = 3 // Packets carrying only acks.
+	OverheadHeaderType     = 4 // The header of packets carrying payload.
+	OverheadRetransmitType = 5 // Retransmitted packets, in full.
+)
@@ -20,6 +20,8 @@ uint64_t sendtoCallback(utp_callback_arguments *);
 uint64_t stateChangeCallback(utp_callback_arguments *);
 uint64_t readCallback(utp_callback_arguments *);
 uint64_t getReadBufferSizeCallback(utp_callback_arguments *);
+uint64_t getUdpMtuCallback(utp_callback_arguments *);
+uint64_t overheadStatisticsCallback(utp_callback_arguments *);
 */
 import "C"
 import "unsafe"
@@ -35,6 +37,17 @@ func (ctx *C.utp_context) setCallbacks() {
 	C.utp_set_callback(ctx, C.UTP_ON_READ, (*C.utp_callback_t)(C.readCallback))
 	C.utp_set_callback(ctx, C.UTP_ON_ERROR, (*C.utp_callback_t)(C.errorCallback))
 	C.utp_set_callback(ctx, C.UTP_GET_READ_BUFFER_SIZE, (*C.utp_callback_t)(C.getReadBufferSizeCallback))
+	C.utp_set_callback(ctx, C.UTP_GET_UDP_MTU, (*C.utp_callback_t)(C.getUdpMtuCallback))
+}
+
+// libutp skips the work of accounting for overhead if there's no callback, so
+// it's only set while there's a user to receive it.
+func setOverheadStatisticsCallback(ctx *C.utp_context, enabled bool) {
+	var f *C.utp_callback_t
+	if enabled {
+		f = (*C.utp_callback_t)(C.overheadStatisticsCallback)
+	}
+	C.utp_set_callback(ctx, C.UTP_ON_OVERHEAD_STATISTICS, f)
 }
 
 func (ctx *C.utp_context) setOption(opt Option, val int) int {
@@ -37,6 +37,12 @@ extern "C" {
 typedef struct UTPSocket					utp_socket;
 typedef struct struct_utp_context			utp_context;
 
+// The version to pass to utp_init.
+#define UTP_API_VERSION 2
+
+// The uTP (BEP 29) packet format version sent and accepted.
+#define UTP_PROTOCOL_VERSION 1
+
 enum {
 	UTP_UDP_DONTFRAG = 2,	// Used to be a #define as UDP_IP_DONTFRAG
 };
@@ -68,6 +74,10 @@ enum {
 
 extern const char *utp_error_code_names[];
 
+// Returned by the UTP_ON_FIREWALL callback to reject a connection with a
+// reset, rather than silently.
+#define UTP_FIREWALL_RESET 2
+
 enum {
 	// callback names
 	UTP_ON_FIREWALL = 0,
@@ -94,6 +104,7 @@ enum {
 	UTP_SNDBUF,
 	UTP_RCVBUF,
 	UTP_TARGET_DELAY,
+	UTP_INITIAL_WINDOW,
 
 	UTP_ARRAY_SIZE,	// must be last
 };
@@ -176,9 +187,20 @@ int				utp_getpeername					(utp_socket *s, struct sockaddr *addr, socklen_t *add
 void			utp_read_drained				(utp_socket *s);
 int				utp_get_delays					(utp_socket *s, uint32 *ours, uint32 *theirs, uint32 *age);
 utp_socket_stats* utp_get_stats					(utp_socket *s);
+uint32			utp_get_rtt						(utp_socket *s);
+uint32			utp_get_mtu						(utp_socket *s);
+size_t			utp_get_send_window				(utp_socket *s);
+size_t			utp_get_bytes_in_flight			(utp_socket *s);
+uint64			utp_get_retransmits				(utp_socket *s);
+void			utp_get_ccontrol_state			(utp_socket *s, uint32 *base_delay, int32 *off_target);
+void			utp_get_ack_stats				(utp_socket *s, uint64 *acks_sent, uint64 *deferred, uint64 *piggybacked, uint32 *last_delay_us);
+void			utp_set_keepalive_interval		(utp_socket *s, uint32 ms);
+void			utp_set_nodelay					(utp_socket *s, int nodelay);
+void			utp_set_weight					(utp_socket *s, int weight);
 utp_context*	utp_get_context					(utp_socket *s);
 void			utp_shutdown					(utp_socket *s, int how);
 void			utp_close						(utp_socket *s);
+void			utp_reset						(utp_socket *s);
 
 #ifdef __cplusplus
 }
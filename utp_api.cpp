@@ -72,6 +72,7 @@ struct_utp_context::struct_utp_context()
 	memset(&context_stats, 0, sizeof(context_stats));
 	memset(callbacks, 0, sizeof(callbacks));
 	target_delay = CCONTROL_TARGET;
+	initial_window = 1;
 	utp_sockets = new UTPSocketHT;
 
 	callbacks[UTP_GET_UDP_MTU]      = &utp_default_get_udp_mtu;
@@ -98,8 +99,8 @@ struct_utp_context::~struct_utp_context() {
 
 utp_context* utp_init (int version)
 {
-	assert(version == 2);
-	if (version != 2)
+	assert(version == UTP_API_VERSION);
+	if (version != UTP_API_VERSION)
 		return NULL;
 	utp_context *ctx = new utp_context;
 	return ctx;
@@ -475,6 +475,35 @@ struct UTPSocket {
 	uint64 last_sent_packet;
 	uint64 last_measured_delay;
 
+	// milliseconds of not sending before a keep-alive is sent, or 0 to
+	// never send them
+	uint32 keepalive_interval;
+
+	// send the last, partly filled packet even while others are in flight,
+	// rather than waiting for more data to fill it
+	bool nodelay;
+
+	// multiplies the congestion window's gain, so that among sockets sharing
+	// a bottleneck, those weighted higher take more of it. 1 is unweighted.
+	int weight;
+
+	// packets sent again, for any reason, maintained regardless of _DEBUG
+	uint64 retransmits;
+
+	// the target delay less our delay, in microseconds, as of the last
+	// congestion control update
+	int32 last_off_target;
+
+	// ack timing, maintained regardless of _DEBUG. acks are counted as
+	// deferred if they were scheduled first, and as piggybacked if a data
+	// packet carried a scheduled ack instead.
+	uint64 acks_sent;
+	uint64 deferred_acks;
+	uint64 piggybacked_acks;
+	// when the pending ack was scheduled, and how long the last one waited
+	uint64 ack_scheduled_us;
+	uint32 last_ack_delay_us;
+
 	// timestamp of the last time the cwnd was full
 	// this is used to prevent the congestion window
 	// from growing when we're not sending at capacity
@@ -548,10 +577,9 @@ struct UTPSocket {
 
 	SizableCircularBuffer inbuf, outbuf;
 
-	#ifdef _DEBUG
-	// Public per-socket statistics, returned by utp_get_stats()
+	// Public per-socket statistics, returned by utp_get_stats(), maintained
+	// regardless of _DEBUG
 	utp_socket_stats _stats;
-	#endif
 
 	// true if we're in slow-start (exponential growth) phase
 	bool slow_start;
@@ -719,6 +747,7 @@ void UTPSocket::schedule_ack()
 		log(UTP_LOG_DEBUG, "schedule_ack");
 		#endif
 		ida = ctx->ack_sockets.Append(this);
+		ack_scheduled_us = utp_call_get_microseconds(ctx, this);
 	} else {
 		#if UTP_DEBUG_LOGGING
 		log(UTP_LOG_DEBUG, "schedule_ack: already in list");
@@ -739,10 +768,8 @@ void UTPSocket::send_data(byte* b, size_t length, bandwidth_type_t type, uint32
 
 	last_sent_packet = ctx->current_ms;
 
-	#ifdef _DEBUG
 	_stats.nbytes_xmit += length;
 	++_stats.nxmit;
-	#endif
 
 	if (ctx->callbacks[UTP_ON_OVERHEAD_STATISTICS]) {
 		size_t n;
@@ -765,6 +792,13 @@ void UTPSocket::send_data(byte* b, size_t length, bandwidth_type_t type, uint32
 		seq_nr, ack_nr);
 #endif
 	send_to_addr(ctx, this, b, length, addr, flags);
+	if (ida >= 0) {
+		last_ack_delay_us = (uint32)(time - ack_scheduled_us);
+		if (type == ack_overhead)
+			deferred_acks++;
+		else
+			piggybacked_acks++;
+	}
 	removeSocketFromAckList(this);
 }
 
@@ -775,7 +809,7 @@ void UTPSocket::send_ack(bool synack)
 
 	size_t len;
 	last_rcv_win = get_rcv_window();
-	pfa.pf.set_version(1);
+	pfa.pf.set_version(UTP_PROTOCOL_VERSION);
 	pfa.pf.set_type(ST_STATE);
 	pfa.pf.ext = 0;
 	pfa.pf.connid = conn_id_send;
@@ -827,6 +861,7 @@ void UTPSocket::send_ack(bool synack)
 		#endif
 	}
 
+	acks_sent++;
 	send_data((byte*)&pfa, len, ack_overhead);
 	removeSocketFromAckList(this);
 }
@@ -850,7 +885,7 @@ void UTPSocket::send_rst(utp_context *ctx,
 	zeromem(&pf1);
 
 	size_t len;
-	pf1.set_version(1);
+	pf1.set_version(UTP_PROTOCOL_VERSION);
 	pf1.set_type(ST_RESET);
 	pf1.ext = 0;
 	pf1.connid = conn_id_send;
@@ -878,6 +913,10 @@ void UTPSocket::send_packet(OutgoingPacket *pkt)
 		cur_window += pkt->payload;
 	}
 
+	if (pkt->transmissions != 0) {
+		retransmits++;
+	}
+
 	pkt->need_resend = false;
 
 	PacketFormatV1* p1 = (PacketFormatV1*)pkt->data;
@@ -976,7 +1015,8 @@ bool UTPSocket::flush_packets()
 		// Nagle check
 		// don't send the last packet if we have one packet in-flight
 		// and the current packet is still smaller than packet_size.
-		if (i != ((seq_nr - 1) & ACK_NR_MASK) ||
+		if (nodelay ||
+			i != ((seq_nr - 1) & ACK_NR_MASK) ||
 			cur_window_packets == 1 ||
 			pkt->payload >= packet_size) {
 			send_packet(pkt);
@@ -1075,7 +1115,7 @@ void UTPSocket::write_outgoing_packet(size_t payload, uint flags, struct utp_iov
 		last_rcv_win = get_rcv_window();
 
 		PacketFormatV1* p1 = (PacketFormatV1*)pkt->data;
-		p1->set_version(1);
+		p1->set_version(UTP_PROTOCOL_VERSION);
 		p1->set_type(flags);
 		p1->ext = 0;
 		p1->connid = conn_id_send;
@@ -1269,7 +1309,7 @@ void UTPSocket::check_timeouts()
 		}
 
 		if (state >= CS_CONNECTED && !fin_sent) {
-			if ((int)(ctx->current_ms - last_sent_packet) >= KEEPALIVE_INTERVAL) {
+			if (keepalive_interval && ctx->current_ms - last_sent_packet >= keepalive_interval) {
 				send_keep_alive();
 			}
 		}
@@ -1595,9 +1635,7 @@ void UTPSocket::selective_ack(uint base, const byte *mask, byte len)
 		// On Loss
 		back_off = true;
 
-		#ifdef _DEBUG
 		++_stats.rexmit;
-		#endif
 
 		send_packet(pkt);
 		fast_resend_seq_nr = (v + 1) & ACK_NR_MASK;
@@ -1650,6 +1688,7 @@ void UTPSocket::apply_ccontrol(size_t bytes_acked, uint32 actual_delay, int64 mi
 	}
 
 	double off_target = target - our_delay;
+	last_off_target = (int32)off_target;
 
 	// this is the same as:
 	//
@@ -1678,6 +1717,10 @@ void UTPSocket::apply_ccontrol(size_t bytes_acked, uint32 actual_delay, int64 mi
 	// the +1. is to allow for floating point imprecision
 	assert(scaled_gain <= 1. + MAX_CWND_INCREASE_BYTES_PER_RTT * (double)min(bytes_acked, max_window) / (double)max(max_window, bytes_acked));
 
+	// the weight applies to decreases as well, so that windows grown from the
+	// minimum together keep to the proportions of their weights
+	scaled_gain *= weight;
+
 	if (scaled_gain > 0 && ctx->current_ms - last_maxed_out_window > 1000) {
 		// if it was more than 1 second since we tried to send a packet
 		// and stopped because we hit the max window, we're most likely rate
@@ -1732,10 +1775,8 @@ void UTPSocket::apply_ccontrol(size_t bytes_acked, uint32 actual_delay, int64 mi
 
 static void utp_register_recv_packet(UTPSocket *conn, size_t len)
 {
-	#ifdef _DEBUG
 	++conn->_stats.nrecv;
 	conn->_stats.nbytes_recv += len;
-	#endif
 
 	if (len <= PACKET_SIZE_MID) {
 		if (len <= PACKET_SIZE_EMPTY) {
@@ -2273,9 +2314,7 @@ size_t utp_process_incoming(UTPSocket *conn, const byte *packet, size_t len, boo
 					conn->log(UTP_LOG_DEBUG, "Packet %u fast timeout-retry.", conn->seq_nr - conn->cur_window_packets);
 					#endif
 
-					#ifdef _DEBUG
 					++conn->_stats.fastrexmit;
-					#endif
 
 					conn->fast_resend_seq_nr++;
 					conn->send_packet(pkt);
@@ -2441,9 +2480,7 @@ size_t utp_process_incoming(UTPSocket *conn, const byte *packet, size_t len, boo
 		// Has this packet already been received? (i.e. a duplicate)
 		// If that is the case, just discard it.
 		if (conn->inbuf.get(pk_seq_nr) != NULL) {
-			#ifdef _DEBUG
 			++conn->_stats.nduprecv;
-			#endif
 
 			return 0;
 		}
@@ -2563,8 +2600,9 @@ void utp_initialize_socket(	utp_socket *conn,
 
 	conn->ctx->utp_sockets->Add(UTPSocketKey(conn->addr, conn->conn_id_recv))->socket = conn;
 
-	// we need to fit one packet in the window when we start the connection
-	conn->max_window = conn->get_packet_size();
+	// we need to fit one packet in the window when we start the connection,
+	// or more if UTP_INITIAL_WINDOW says so
+	conn->max_window = conn->get_packet_size() * conn->ctx->initial_window;
 
 	#if UTP_DEBUG_LOGGING
 	conn->log(UTP_LOG_DEBUG, "UTP socket initialized");
@@ -2614,6 +2652,16 @@ utp_socket*	utp_create_socket(utp_context *ctx)
 	conn->cur_window_packets	= 0;
 	conn->fast_resend_seq_nr	= conn->seq_nr;
 	conn->target_delay			= ctx->target_delay;
+	conn->keepalive_interval	= KEEPALIVE_INTERVAL;
+	conn->nodelay				= false;
+	conn->weight				= 1;
+	conn->retransmits			= 0;
+	conn->last_off_target		= 0;
+	conn->acks_sent				= 0;
+	conn->deferred_acks			= 0;
+	conn->piggybacked_acks		= 0;
+	conn->ack_scheduled_us		= 0;
+	conn->last_ack_delay_us		= 0;
 	conn->reply_micro			= 0;
 	conn->opt_sndbuf			= ctx->opt_sndbuf;
 	conn->opt_rcvbuf			= ctx->opt_rcvbuf;
@@ -2630,9 +2678,7 @@ utp_socket*	utp_create_socket(utp_context *ctx)
 
 	memset(conn->extensions, 0, sizeof(conn->extensions));
 
-	#ifdef _DEBUG
 	memset(&conn->_stats, 0, sizeof(utp_socket_stats));
-	#endif
 
 	return conn;
 }
@@ -2668,6 +2714,11 @@ int utp_context_set_option(utp_context *ctx, int opt, int val)
 			assert(val >= 1);
 			ctx->opt_rcvbuf = val;
 			return 0;
+
+		case UTP_INITIAL_WINDOW:
+			assert(val >= 1);
+			ctx->initial_window = val;
+			return 0;
 	}
 	return -1;
 }
@@ -2684,6 +2735,7 @@ int utp_context_get_option(utp_context *ctx, int opt)
     	case UTP_TARGET_DELAY:	return ctx->target_delay;
 		case UTP_SNDBUF:		return ctx->opt_sndbuf;
 		case UTP_RCVBUF:		return ctx->opt_rcvbuf;
+		case UTP_INITIAL_WINDOW:	return ctx->initial_window;
 	}
 	return -1;
 }
@@ -2776,7 +2828,7 @@ int utp_connect(utp_socket *conn, const struct sockaddr *to, socklen_t tolen)
 	memset(p1, 0, header_size);
 	// SYN packets are special, and have the receive ID in the connid field,
 	// instead of conn_id_send.
-	p1->set_version(1);
+	p1->set_version(UTP_PROTOCOL_VERSION);
 	p1->set_type(ST_SYN);
 	p1->ext = 0;
 	p1->connid = conn->conn_id_recv;
@@ -2832,7 +2884,7 @@ int utp_process_udp(utp_context *ctx, const byte *buffer, size_t len, const stru
 	const byte version = UTP_Version(pf1);
 	const uint32 id = uint32(pf1->connid);
 
-	if (version != 1) {
+	if (version != UTP_PROTOCOL_VERSION) {
 		#if UTP_DEBUG_LOGGING
 		ctx->log(UTP_LOG_DEBUG, NULL, "recv %s len:%u version:%u unsupported version", addrfmt(addr, addrbuf), (uint)len, version);
 		#endif
@@ -2864,13 +2916,15 @@ int utp_process_udp(utp_context *ctx, const byte *buffer, size_t len, const stru
 			ctx->log(UTP_LOG_DEBUG, NULL, "recv RST for existing connection");
 			#endif
 
+			// This must be decided before the state is changed.
+			const int err = (conn->state == CS_SYN_SENT) ? UTP_ECONNREFUSED : UTP_ECONNRESET;
+
 			if (conn->close_requested)
 				conn->state = CS_DESTROY;
 			else
 				conn->state = CS_RESET;
 
 			utp_call_on_overhead_statistics(conn->ctx, conn, false, len + conn->get_udp_overhead(), close_overhead);
-			const int err = (conn->state == CS_SYN_SENT) ? UTP_ECONNREFUSED : UTP_ECONNRESET;
 			utp_call_on_error(conn->ctx, conn, err);
 		}
 		else {
@@ -2973,12 +3027,16 @@ int utp_process_udp(utp_context *ctx, const byte *buffer, size_t len, const stru
 			return 1;
 		}
 		// true means yes, block connection.  false means no, don't block.
-		if (utp_call_on_firewall(ctx, to, tolen)) {
+		// UTP_FIREWALL_RESET blocks it, and tells the peer so it fails fast.
+		const int firewall = utp_call_on_firewall(ctx, to, tolen);
+		if (firewall) {
 
 			#if UTP_DEBUG_LOGGING
-			ctx->log(UTP_LOG_DEBUG, NULL, "rejected incoming connection, firewall callback returned true");
+			ctx->log(UTP_LOG_DEBUG, NULL, "rejected incoming connection, firewall callback returned %d", firewall);
 			#endif
 
+			if (firewall == UTP_FIREWALL_RESET)
+				UTPSocket::send_rst(ctx, addr, id, seq_nr, utp_call_get_random(ctx, NULL));
 			return 1;
 		}
 
@@ -3044,7 +3102,7 @@ static UTPSocket* parse_icmp_payload(utp_context *ctx, const byte *buffer, size_
 	const byte version = UTP_Version(pf);
 	const uint32 id = uint32(pf->connid);
 
-	if (version != 1) {
+	if (version != UTP_PROTOCOL_VERSION) {
 		#if UTP_DEBUG_LOGGING
 		ctx->log(UTP_LOG_DEBUG, NULL, "Ignoring ICMP from %s: not UTP version 1", addrfmt(addr, addrbuf));
 		#endif
@@ -3395,6 +3453,35 @@ void utp_close(UTPSocket *conn)
 	#endif
 }
 
+// Aborts the connection: the peer is sent a reset, unless it's yet to hear
+// from us, and the socket is destroyed without sending anything else. As with
+// utp_close, the socket mustn't be used afterwards.
+void utp_reset(UTPSocket *conn)
+{
+	assert(conn);
+	if (!conn) return;
+
+	#if UTP_DEBUG_LOGGING
+	conn->log(UTP_LOG_DEBUG, "UTP_Reset in state:%s", statenames[conn->state]);
+	#endif
+
+	switch(conn->state) {
+	case CS_UNINITIALIZED:
+	case CS_DESTROY:
+		return;
+	case CS_SYN_RECV:
+	case CS_CONNECTED:
+	case CS_CONNECTED_FULL:
+		UTPSocket::send_rst(conn->ctx, conn->addr, conn->conn_id_send, conn->ack_nr, conn->seq_nr);
+		break;
+	default:
+		break;
+	}
+	conn->read_shutdown = true;
+	conn->close_requested = true;
+	conn->state = CS_DESTROY;
+}
+
 void utp_shutdown(UTPSocket *conn, int how)
 {
 	assert(conn);
@@ -3478,12 +3565,102 @@ inline bool struct_utp_context::would_log(int level)
 
 utp_socket_stats* utp_get_stats(utp_socket *socket)
 {
-	#ifdef _DEBUG
-		assert(socket);
-		if (!socket) return NULL;
-		socket->_stats.mtu_guess = socket->mtu_last ? socket->mtu_last : socket->mtu_ceiling;
-		return &socket->_stats;
-	#else
-		return NULL;
-	#endif
+	assert(socket);
+	if (!socket) return NULL;
+	socket->_stats.mtu_guess = socket->mtu_last ? socket->mtu_last : socket->mtu_ceiling;
+	return &socket->_stats;
+}
+
+// Returns the smoothed round trip time estimate in milliseconds, or 0 if
+// there hasn't been a sample yet.
+uint32 utp_get_rtt(utp_socket *socket)
+{
+	assert(socket);
+	return socket ? socket->rtt : 0;
+}
+
+// Returns the packet size currently in use, which changes as the path MTU is
+// discovered. This is the same as utp_socket_stats.mtu_guess.
+uint32 utp_get_mtu(utp_socket *socket)
+{
+	assert(socket);
+	if (!socket) return 0;
+	return socket->mtu_last ? socket->mtu_last : socket->mtu_ceiling;
+}
+
+// Returns the number of bytes that may be in flight at once. This is the
+// congestion window, further limited by the send buffer and the peer's
+// advertised receive window, as used by UTPSocket::is_full.
+size_t utp_get_send_window(utp_socket *socket)
+{
+	assert(socket);
+	if (!socket) return 0;
+	return min(socket->max_window, socket->opt_sndbuf, socket->max_window_user);
+}
+
+// Sets the milliseconds of not sending after which a keep-alive is sent. 0
+// disables keep-alives. The default is KEEPALIVE_INTERVAL.
+void utp_set_keepalive_interval(utp_socket *socket, uint32 ms)
+{
+	assert(socket);
+	if (!socket) return;
+	socket->keepalive_interval = ms;
+}
+
+// Sets whether the last packet is sent without waiting to be filled when
+// others are in flight, disabling the Nagle check in flush_packets.
+void utp_set_nodelay(utp_socket *socket, int nodelay)
+{
+	assert(socket);
+	if (!socket) return;
+	socket->nodelay = nodelay != 0;
+	if (nodelay && (socket->state == CS_CONNECTED || socket->state == CS_CONNECTED_FULL))
+		socket->flush_packets();
+}
+
+// Sets the multiplier of the socket's congestion window gain, at least 1.
+void utp_set_weight(utp_socket *socket, int weight)
+{
+	assert(socket);
+	if (!socket) return;
+	socket->weight = weight < 1 ? 1 : weight;
+}
+
+// Returns the number of packets sent again, whether after a timeout, or
+// because they were reported lost, or fast retransmits.
+uint64 utp_get_retransmits(utp_socket *socket)
+{
+	assert(socket);
+	return socket ? socket->retransmits : 0;
+}
+
+// Returns the lowest one-way delay sample from recent minutes, which includes
+// the offset between the clocks, and the target delay less the queuing delay
+// as of the last congestion control update, both in microseconds.
+void utp_get_ccontrol_state(utp_socket *socket, uint32 *base_delay, int32 *off_target)
+{
+	assert(socket);
+	if (!socket) return;
+	if (base_delay) *base_delay = socket->our_hist.delay_base;
+	if (off_target) *off_target = socket->last_off_target;
+}
+
+// Returns the acks sent on their own, those of them that were scheduled
+// rather than sent immediately, the scheduled acks carried by data packets
+// instead, and the microseconds the last scheduled ack waited to be sent.
+void utp_get_ack_stats(utp_socket *socket, uint64 *acks_sent, uint64 *deferred, uint64 *piggybacked, uint32 *last_delay_us)
+{
+	assert(socket);
+	if (!socket) return;
+	if (acks_sent) *acks_sent = socket->acks_sent;
+	if (deferred) *deferred = socket->deferred_acks;
+	if (piggybacked) *piggybacked = socket->piggybacked_acks;
+	if (last_delay_us) *last_delay_us = socket->last_ack_delay_us;
+}
+
+// Returns the number of payload bytes sent but not yet acknowledged.
+size_t utp_get_bytes_in_flight(utp_socket *socket)
+{
+	assert(socket);
+	return socket ? socket->cur_window : 0;
 }
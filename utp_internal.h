@@ -124,6 +124,8 @@ struct struct_utp_context {
 	size_t target_delay;
 	size_t opt_sndbuf;
 	size_t opt_rcvbuf;
+	// the congestion window new sockets start with, in packets
+	size_t initial_window;
 	uint64 last_check;
 
 	struct_utp_context();
@@ -2,6 +2,7 @@ package utp
 
 import (
 	"context"
+	"errors"
 	"log"
 	"math"
 	"net"
@@ -207,3 +208,146 @@ func TestMaxExpiryTimerMath(t *testing.T) {
 		return i == math.MaxInt64 || i < 0
 	}, nil)
 }
+
+func TestDialContextCancelled(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	c, err := s.DialContext(ctx, "", neverResponds)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, c)
+}
+
+func TestDialUDPContextLocalAddr(t *testing.T) {
+	s, err := NewSocket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := s.Accept()
+		require.NoError(t, err)
+		accepted <- c
+	}()
+	c, err := DialUDPContext(context.Background(), "udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, s.Addr().String())
+	require.NoError(t, err)
+	a := <-accepted
+	defer a.Close()
+	la := c.LocalAddr().(*net.UDPAddr)
+	assert.True(t, la.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.NotEqual(t, s.Addr().(*net.UDPAddr).Port, la.Port)
+	assert.Equal(t, la.Port, a.RemoteAddr().(*net.UDPAddr).Port)
+	require.NoError(t, c.CloseWithTimeout(5*time.Second))
+	// The Socket created for the Conn is closed asynchronously.
+	for {
+		mu.Lock()
+		closed := c.s.closed
+		mu.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDialUDPContextAddressFamilyMismatch(t *testing.T) {
+	_, err := DialUDPContext(context.Background(), "udp", &net.UDPAddr{IP: net.IPv6loopback}, "127.0.0.1:1")
+	assert.Error(t, err)
+}
+
+func TestPackageDialTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 100 * time.Millisecond
+	started := time.Now()
+	c, err := DialTimeout("udp", neverResponds, timeout)
+	assert.Nil(t, c)
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.True(t, time.Since(started) >= timeout)
+}
+
+func TestDialer(t *testing.T) {
+	s, err := NewSocket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := s.Accept()
+		require.NoError(t, err)
+		accepted <- c
+	}()
+	d := Dialer{LocalAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	var dial func(context.Context, string, string) (net.Conn, error) = d.DialContext
+	c, err := dial(context.Background(), "tcp", s.Addr().String())
+	require.NoError(t, err)
+	a := <-accepted
+	defer a.Close()
+	assert.Equal(t, c.LocalAddr().String(), a.RemoteAddr().String())
+	require.NoError(t, c.Close())
+
+	_, err = d.Dial("ip", s.Addr().String())
+	assert.Error(t, err)
+	d.LocalAddr = &net.TCPAddr{}
+	_, err = d.Dial("udp", s.Addr().String())
+	assert.Error(t, err)
+}
+
+func numLibContexts() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(libContextToSocket)
+}
+
+func TestDialMulti(t *testing.T) {
+	s, err := NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	go func() {
+		c, err := s.Accept()
+		if err == nil {
+			defer c.Close()
+		}
+	}()
+	before := numLibContexts()
+	c, err := DialMulti(context.Background(), "udp", []string{neverResponds, s.Addr().String(), neverResponds})
+	require.NoError(t, err)
+	assert.Equal(t, s.Addr().String(), c.RemoteAddr().String())
+	// The losers' Sockets are closed, if not by the time DialMulti returns.
+	for numLibContexts() != before+1 {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, c.Close())
+
+	_, err = DialMulti(context.Background(), "udp", nil)
+	assert.Error(t, err)
+}
+
+func TestDialMultiAllFail(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c, err := DialMulti(ctx, "udp", []string{neverResponds, "localhost:2"})
+	assert.Nil(t, c)
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.Contains(t, err.Error(), neverResponds)
+	assert.Contains(t, err.Error(), "localhost:2")
+	var ne net.Error
+	assert.True(t, errors.As(err, &ne))
+}
+
+func TestDialerTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 100 * time.Millisecond
+	for _, d := range []Dialer{
+		{Timeout: timeout},
+		{Deadline: time.Now().Add(timeout)},
+		{Timeout: time.Hour, Deadline: time.Now().Add(timeout)},
+	} {
+		c, err := d.Dial("udp", neverResponds)
+		assert.Nil(t, c)
+		require.Error(t, err)
+		assert.True(t, err.(net.Error).Timeout())
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/anacrolix/go-libutp/utpprom
+
+go 1.16
+
+require (
+	github.com/anacrolix/go-libutp v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.11.0
+	github.com/stretchr/testify v1.4.0
+)
+
+replace github.com/anacrolix/go-libutp => ../
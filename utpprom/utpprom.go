@@ -0,0 +1,96 @@
+// Package utpprom exports the totals from go-libutp Sockets as Prometheus
+// metrics.
+package utpprom
+
+import (
+	"sync"
+
+	utp "github.com/anacrolix/go-libutp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connsOpenDesc = prometheus.NewDesc(
+		"utp_conns_open", "Conns counted by Socket.NumConns.",
+		[]string{"socket"}, nil)
+	connsAcceptedDesc = prometheus.NewDesc(
+		"utp_conns_accepted_total", "Conns accepted by the Socket.",
+		[]string{"socket"}, nil)
+	connsDialedDesc = prometheus.NewDesc(
+		"utp_conns_dialed_total", "Conns dialed from the Socket.",
+		[]string{"socket"}, nil)
+	bytesReadDesc = prometheus.NewDesc(
+		"utp_read_bytes_total", "Bytes read from the Socket's Conns.",
+		[]string{"socket"}, nil)
+	bytesWrittenDesc = prometheus.NewDesc(
+		"utp_written_bytes_total", "Bytes written to the Socket's Conns.",
+		[]string{"socket"}, nil)
+	retransmitsDesc = prometheus.NewDesc(
+		"utp_retransmits_total", "Packets sent again by the Socket's Conns.",
+		[]string{"socket"}, nil)
+	rttDesc = prometheus.NewDesc(
+		"utp_rtt_seconds", "Mean round trip time estimate for the Socket's open Conns.",
+		[]string{"socket"}, nil)
+)
+
+// A prometheus.Collector for a set of named Sockets. Each metric has a
+// "socket" label with the name given to Add.
+type Collector struct {
+	mu      sync.Mutex
+	sockets map[string]*utp.Socket
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+func NewCollector() *Collector {
+	return &Collector{sockets: make(map[string]*utp.Socket)}
+}
+
+// Adds a Socket to be collected under name, replacing any Socket already
+// there. Sockets are removed once they've been collected after closing.
+func (c *Collector) Add(name string, s *utp.Socket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sockets[name] = s
+}
+
+func (c *Collector) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sockets, name)
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connsOpenDesc
+	ch <- connsAcceptedDesc
+	ch <- connsDialedDesc
+	ch <- bytesReadDesc
+	ch <- bytesWrittenDesc
+	ch <- retransmitsDesc
+	ch <- rttDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, s := range c.sockets {
+		st := s.Stats()
+		gauge := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, name)
+		}
+		counter := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, name)
+		}
+		gauge(connsOpenDesc, float64(st.ConnsOpen))
+		counter(connsAcceptedDesc, float64(st.ConnsAccepted))
+		counter(connsDialedDesc, float64(st.ConnsDialed))
+		counter(bytesReadDesc, float64(st.BytesRead))
+		counter(bytesWrittenDesc, float64(st.BytesWritten))
+		counter(retransmitsDesc, float64(st.Retransmits))
+		gauge(rttDesc, st.MeanRTT.Seconds())
+		if st.Closed {
+			// Its totals won't change, and it would be reported forever.
+			delete(c.sockets, name)
+		}
+	}
+}
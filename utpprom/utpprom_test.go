@@ -0,0 +1,37 @@
+package utpprom
+
+import (
+	"testing"
+
+	utp "github.com/anacrolix/go-libutp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	s, err := utp.NewSocket("udp", "localhost:0")
+	require.NoError(t, err)
+	c := NewCollector()
+	c.Add("test", s)
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	var names []string
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+		require.Len(t, mf.GetMetric(), 1)
+		assert.Equal(t, "test", mf.GetMetric()[0].GetLabel()[0].GetValue())
+	}
+	assert.Contains(t, names, "utp_conns_open")
+	assert.Contains(t, names, "utp_retransmits_total")
+	require.NoError(t, s.Close())
+	// A closed Socket is reported once more, and then dropped.
+	mfs, err = reg.Gather()
+	require.NoError(t, err)
+	assert.NotEmpty(t, mfs)
+	mfs, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, mfs)
+}
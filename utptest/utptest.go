@@ -0,0 +1,183 @@
+// Package utptest connects pairs of Sockets in memory, with simulated
+// latency, jitter and loss, for testing protocols over uTP without real UDP.
+package utptest
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	utp "github.com/anacrolix/go-libutp"
+)
+
+// Configures the link between Sockets from Pipe. The impairments apply to
+// each direction independently.
+type Option func(*config)
+
+type config struct {
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	seed    int64
+}
+
+// Delays every datagram by d.
+func Latency(d time.Duration) Option {
+	return func(c *config) { c.latency = d }
+}
+
+// Delays every datagram by a further random duration up to d, so datagrams
+// can arrive out of order.
+func Jitter(d time.Duration) Option {
+	return func(c *config) { c.jitter = d }
+}
+
+// Drops each datagram with probability p.
+func Loss(p float64) Option {
+	return func(c *config) { c.loss = p }
+}
+
+// Seeds the choice of which datagrams are dropped or jittered. The default
+// is 1, so a run with the same sequence of datagrams is impaired the same
+// way.
+func Seed(seed int64) Option {
+	return func(c *config) { c.seed = seed }
+}
+
+// Returns two Sockets connected to each other in memory. Each can dial the
+// other's Addr, and they're closed independently.
+func Pipe(opts ...Option) (a, b *utp.Socket) {
+	cfg := config{seed: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	addrs := [2]*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 1},
+	}
+	var ss [2]*utp.Socket
+	for i := range ss {
+		l := &link{
+			cfg:  cfg,
+			rand: rand.New(rand.NewSource(cfg.seed + int64(i))),
+			from: addrs[i],
+			to:   &ss[1-i],
+		}
+		s, err := utp.NewSocketWithSendTo(l.send, addrs[i])
+		if err != nil {
+			panic(err)
+		}
+		ss[i] = s
+	}
+	return ss[0], ss[1]
+}
+
+// Carries datagrams one way, delivering them to the other Socket from a
+// goroutine that runs while any are in flight.
+type link struct {
+	cfg  config
+	from net.Addr
+	to   **utp.Socket
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	queue    packetQueue
+	seq      int
+	pumping  bool
+	wake     chan struct{}
+	shutdown bool
+}
+
+type packet struct {
+	b   []byte
+	at  time.Time
+	seq int
+}
+
+// Called by the Socket with its package's lock held, so it only queues.
+func (l *link) send(b []byte, _ net.Addr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shutdown {
+		return nil
+	}
+	if l.cfg.loss != 0 && l.rand.Float64() < l.cfg.loss {
+		return nil
+	}
+	delay := l.cfg.latency
+	if l.cfg.jitter != 0 {
+		delay += time.Duration(l.rand.Int63n(int64(l.cfg.jitter)))
+	}
+	heap.Push(&l.queue, packet{
+		b:   append([]byte(nil), b...),
+		at:  time.Now().Add(delay),
+		seq: l.seq,
+	})
+	l.seq++
+	if !l.pumping {
+		l.pumping = true
+		l.wake = make(chan struct{}, 1)
+		go l.pump()
+	} else {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (l *link) pump() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.queue) != 0 {
+		if d := time.Until(l.queue[0].at); d > 0 {
+			// A datagram due sooner may be queued while we wait.
+			wake := l.wake
+			l.mu.Unlock()
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-wake:
+				t.Stop()
+			}
+			l.mu.Lock()
+			continue
+		}
+		p := heap.Pop(&l.queue).(packet)
+		l.mu.Unlock()
+		err := (*l.to).ReceivePacket(p.b, l.from)
+		l.mu.Lock()
+		if err != nil {
+			// The receiving Socket is closed, so nothing more will arrive.
+			l.shutdown = true
+			l.queue = nil
+		}
+	}
+	l.pumping = false
+}
+
+// Orders datagrams by delivery time, then by when they were sent.
+type packetQueue []packet
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(packet)) }
+
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
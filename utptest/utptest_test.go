@@ -0,0 +1,94 @@
+package utptest
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	utp "github.com/anacrolix/go-libutp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTransfer(t *testing.T, opts ...Option) {
+	a, b := Pipe(opts...)
+	defer a.Close()
+	defer b.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := b.Accept()
+		require.NoError(t, err)
+		accepted <- c
+	}()
+	d, err := a.Dial(b.Addr().String())
+	require.NoError(t, err)
+	defer d.Close()
+	c := <-accepted
+	defer c.Close()
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(0)).Read(data)
+	go d.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(c, got)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestPipe(t *testing.T) {
+	testTransfer(t)
+}
+
+func TestPipeImpaired(t *testing.T) {
+	started := time.Now()
+	testTransfer(t, Latency(10*time.Millisecond), Jitter(5*time.Millisecond), Loss(0.02))
+	// The handshake alone takes a round trip.
+	assert.True(t, time.Since(started) >= 20*time.Millisecond)
+}
+
+// Transfers over a link with a 50ms round trip to a receiver with a small
+// buffer that reads in small pieces, and pauses long enough now and then for
+// the buffer to fill, so the rate depends on how soon reads reopen the
+// receive window.
+func BenchmarkSmallReadsHighLatency(b *testing.B) {
+	const n = 512 << 10
+	s1, s2 := Pipe(Latency(25 * time.Millisecond))
+	defer s1.Close()
+	defer s2.Close()
+	accepted := make(chan *utp.Conn, 1)
+	go func() {
+		c, err := s2.Accept()
+		require.NoError(b, err)
+		accepted <- c.(*utp.Conn)
+	}()
+	d, err := s1.Dial(s2.Addr().String())
+	require.NoError(b, err)
+	defer d.Close()
+	c := <-accepted
+	defer c.Close()
+	require.NoError(b, c.SetReadBuffer(64<<10))
+	buf := make([]byte, 1<<10)
+	b.SetBytes(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for read := 0; read < n; {
+				m, err := c.Read(buf)
+				require.NoError(b, err)
+				read += m
+				// As though handling each piece.
+				time.Sleep(time.Millisecond)
+				if read%(64<<10) < m {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}()
+		_, err := d.Write(make([]byte, n))
+		require.NoError(b, err)
+		<-done
+	}
+}
@@ -0,0 +1,50 @@
+package utp
+
+/*
+#include "utp.h"
+*/
+import "C"
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// The uTP packet format version spoken, as in BEP 29.
+const ProtocolVersion = C.UTP_PROTOCOL_VERSION
+
+// The SHA-256 of the bundled libutp sources, with LF line endings. It isn't a
+// version: the sources carry changes of our own, so don't correspond to an
+// upstream commit, and digests don't order. It only tells builds with
+// different sources apart. TestLibutpSourceDigest fails until this is updated
+// alongside them.
+const libutpSourceDigest = "f0b8da35bffd29728941dc0ff32fc7d655c4604407aeeee2d90a531095be3024"
+
+const modulePath = "github.com/anacrolix/go-libutp"
+
+// Returns the version of this module as built, a prefix of the digest of the
+// bundled libutp sources, and ProtocolVersion, for bug reports. The module
+// version is "(devel)" or "unknown" if it's not recorded in the binary.
+func Version() string {
+	return fmt.Sprintf("go-libutp %s, libutp sources %s, uTP protocol %d",
+		moduleVersion(), libutpSourceDigest[:12], ProtocolVersion)
+}
+
+func moduleVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if m.Path != modulePath {
+			continue
+		}
+		if m.Replace != nil {
+			return m.Replace.Version
+		}
+		return m.Version
+	}
+	return "unknown"
+}
@@ -0,0 +1,44 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Line endings are normalized, as checkouts on Windows may convert them.
+func TestLibutpSourceDigest(t *testing.T) {
+	var names []string
+	for _, p := range []string{"*.cpp", "*.h"} {
+		m, err := filepath.Glob(p)
+		require.NoError(t, err)
+		names = append(names, m...)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, n := range names {
+		b, err := ioutil.ReadFile(n)
+		require.NoError(t, err)
+		b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+		fmt.Fprintf(h, "%s\x00%d\x00", n, len(b))
+		h.Write(b)
+	}
+	assert.Equal(t, fmt.Sprintf("%x", h.Sum(nil)), libutpSourceDigest,
+		"update libutpSourceDigest for the changed libutp sources")
+}
+
+func TestVersion(t *testing.T) {
+	v := Version()
+	t.Log(v)
+	assert.True(t, strings.HasPrefix(v, "go-libutp "))
+	assert.Contains(t, v, libutpSourceDigest[:12])
+	assert.Contains(t, v, "uTP protocol 1")
+}